@@ -7,6 +7,7 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
 	"github.com/cznic/mathutil"
 	"net"
@@ -415,3 +416,93 @@ func TestMatch(t *testing.T) {
 		}
 	}
 }
+
+func TestDomainNameDecode(t *testing.T) {
+	long := []byte{}
+	for i := 0; i < 4; i++ {
+		long = append(long, 63)
+		long = append(long, strings.Repeat("x", 63)...)
+	}
+	long = append(long, 0)
+	for i, test := range []struct {
+		b   []byte
+		pos int
+		e   string
+		end int
+		err error
+	}{
+		{[]byte{0}, 0, ".", 1, nil},
+		{[]byte{3, 'c', 'o', 'm', 0}, 0, "com.", 5, nil},
+		{[]byte{3, 'c', 'o', 'm', 0, 3, 'w', 'w', 'w', 0xC0, 0}, 5, "www.com.", 11, nil},
+		{[]byte{3, 'c', 'o', 'm', 0, 0xC0, 0, 3, 'w', 'w', 'w', 0xC0, 5}, 7, "www.com.", 13, nil},
+		{[]byte{}, 0, "", 0, ErrUnderflow},
+		{[]byte{3, 'c', 'o', 'm'}, 0, "", 0, ErrUnderflow},
+		{[]byte{3, 'c', 'o'}, 0, "", 0, ErrUnderflow},
+		{[]byte{0xC0}, 0, "", 0, ErrUnderflow},
+		{[]byte{0xC0, 0}, 0, "", 0, ErrPointer},                          // self
+		{[]byte{0xC0, 2, 0}, 0, "", 0, ErrPointer},                       // forward
+		{[]byte{1, 'a', 0xC0, 0}, 0, "", 0, ErrPointer},                  // loop
+		{[]byte{1, 'a', 0xC0, 0, 1, 'b', 0xC0, 2}, 4, "", 0, ErrPointer}, // loop
+		{[]byte{0x40, 0}, 0, "", 0, ErrLabelLen},
+		{[]byte{0x80, 0}, 0, "", 0, ErrLabelLen},
+		{long, 0, "", 0, ErrNameLen},
+		{long[64:], 0, strings.Repeat(strings.Repeat("x", 63)+".", 3), 193, nil},
+	} {
+		var name DomainName
+		pos := test.pos
+		err := name.Decode(test.b, &pos, nil)
+		if !errors.Is(err, test.err) {
+			t.Fatal(10, i, err, test.err)
+		}
+
+		if err != nil {
+			if _, ok := err.(*DecodeError); !ok {
+				t.Fatal(20, i, err)
+			}
+			continue
+		}
+
+		if string(name) != test.e || pos != test.end {
+			t.Fatal(30, i, name, pos, test.e, test.end)
+		}
+	}
+
+	// A chain of MaxPointers+1 pointers, each to the previous one.
+	b := []byte{0}
+	for i, prev := 0, 0; i <= MaxPointers; i++ {
+		prev, b = len(b), append(b, 0xC0|byte(prev>>8), byte(prev))
+	}
+	var name DomainName
+	pos := len(b) - 2
+	if err := name.Decode(b, &pos, nil); !errors.Is(err, ErrPointerLimit) {
+		t.Fatal(40, err)
+	}
+}
+
+func FuzzDomainNameDecode(f *testing.F) {
+	f.Add([]byte{3, 'c', 'o', 'm', 0, 3, 'w', 'w', 'w', 0xC0, 0}, 5)
+	f.Add([]byte{1, 'a', 0xC0, 0}, 0)
+	f.Add([]byte{0x40, 0}, 0)
+	f.Fuzz(func(t *testing.T, b []byte, pos int) {
+		if pos < 0 || pos > len(b) {
+			return
+		}
+
+		var name DomainName
+		p := pos
+		if err := name.Decode(b, &p, nil); err != nil {
+			if _, ok := err.(*DecodeError); !ok {
+				t.Fatal(10, err)
+			}
+			return
+		}
+
+		if p <= pos || p > len(b) {
+			t.Fatal(20, p)
+		}
+
+		if _, err := Labels(string(name)); err != nil && !strings.Contains(string(name), "..") {
+			t.Fatal(30, name, err)
+		}
+	})
+}
@@ -7,11 +7,13 @@
 package cache
 
 import (
+	"bytes"
 	"flag"
 	"fmt"
 	"github.com/cznic/dns/rr"
 	"net"
 	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -287,3 +289,300 @@ func BenchmarkCacheGetExpired(b *testing.B) {
 		c.Get(domain)
 	}
 }
+
+func TestShards(t *testing.T) {
+	c := New()
+	if g, e := c.shard("Example.COM."), c.shard("example.com."); g != e {
+		t.Fatal(10, "case sensitive shard selection")
+	}
+
+	c.Add(rr.RRs{a("x.example.com.", 10, 1), a("y.example.com.", 10, 2), a("z.example.org.", 10, 3)})
+	n := 0
+	c.Enum("example.com.", func(path []string, found rr.Bytes) bool {
+		n += len(found.Unpack())
+		return true
+	})
+	if n != 2 {
+		t.Fatal(20, n, "!= 2")
+	}
+
+	n = 0
+	c.Enum(".", func(path []string, found rr.Bytes) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Fatal(30, n, "!= 1")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	c := New()
+
+	c.Add(rr.RRs{a(".", 1, 1), aaaa(".", 10, 2)})
+	<-time.After(1.1e9)
+	if _, hit := c.Get("."); !hit {
+		t.Fatal(10)
+	}
+
+	s := c.shard(".")
+	e, ok := s.tree.Get(".").(*entry)
+	if !ok {
+		t.Fatal(20)
+	}
+
+	if n := len(e.data.Unpack()); n != 1 {
+		t.Fatal(30, n, "!= 1")
+	}
+}
+
+func benchmarkCacheParallel(b *testing.B, c *Cache, ndomains int, write bool) {
+	b.StopTimer()
+	domains := make([]string, ndomains)
+	for i := range domains {
+		domains[i] = fmt.Sprintf("i%d.example.com.", i)
+		c.Add(rr.RRs{a(domains[i], 24*3600, i)})
+	}
+
+	b.StartTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			domain := domains[i%ndomains]
+			if write && i%10 == 0 {
+				c.Add(rr.RRs{a(domain, 24*3600, i)})
+			} else {
+				c.Get(domain)
+			}
+			i++
+		}
+	})
+}
+
+// Run with e.g. -cpu 1,2,4,8 to see the throughput scaling with GOMAXPROCS.
+func BenchmarkCacheGetParallel(b *testing.B) {
+	benchmarkCacheParallel(b, New(), 1<<12, false)
+}
+
+// The single shard variant is the equivalent of a Cache guarded by one lock.
+func BenchmarkCacheGetParallel1Shard(b *testing.B) {
+	benchmarkCacheParallel(b, newCache(1), 1<<12, false)
+}
+
+func BenchmarkCacheAddGetParallel(b *testing.B) {
+	benchmarkCacheParallel(b, New(), 1<<12, true)
+}
+
+func BenchmarkCacheAddGetParallel1Shard(b *testing.B) {
+	benchmarkCacheParallel(b, newCache(1), 1<<12, true)
+}
+
+func TestPolicy(t *testing.T) {
+	c := New()
+	c.SetPolicy(&Policy{
+		MinTTL:    60,
+		MaxTTL:    3600,
+		NegMaxTTL: 10,
+		Types: map[rr.Type]TypePolicy{
+			rr.TYPE_AAAA:   {MaxTTL: 100},
+			rr.TYPE_DNSKEY: {NoCache: true},
+		},
+		NoCache: []string{"example.org."},
+	})
+
+	rec := a("x.", 1, 1)
+	c.Add(rr.RRs{rec, aaaa(".", 1e6, 2), a("y.", 0, 2), a("www.Example.org.", 100, 3)})
+	if rec.TTL != 1 {
+		t.Fatal(10, rec.TTL, "!= 1")
+	}
+
+	found, hit := c.Get("x.")
+	if !hit {
+		t.Fatal(20)
+	}
+
+	if ttl := found[0].TTL; ttl < 59 || ttl > 60 {
+		t.Fatal(30, ttl)
+	}
+
+	if found, hit = c.Get("."); !hit {
+		t.Fatal(40)
+	}
+
+	if ttl := found[0].TTL; ttl < 99 || ttl > 100 {
+		t.Fatal(50, ttl)
+	}
+
+	if found, hit = c.Get("y."); hit {
+		t.Fatal(60, found)
+	}
+
+	if found, hit = c.Get("www.example.org."); hit {
+		t.Fatal(70, found)
+	}
+
+	c.Add(rr.RRs{{"z.", rr.TYPE_NXDOMAIN, rr.CLASS_IN, 3600, &rr.NXDOMAIN{}}})
+	if found, hit = c.Get("z."); !hit {
+		t.Fatal(80)
+	}
+
+	if ttl := found[0].TTL; ttl < 9 || ttl > 10 {
+		t.Fatal(90, ttl)
+	}
+
+	p := c.Policy()
+	if p.Cacheable(rr.TYPE_DNSKEY) || !p.Cacheable(rr.TYPE_A) {
+		t.Fatal(100)
+	}
+
+	c.SetPolicy(nil)
+	if c.Policy() != nil {
+		t.Fatal(110)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	c := New()
+	c.Add(rr.RRs{
+		a("example.com.", 100, 1),
+		{"example.com.", rr.TYPE_NS, rr.CLASS_IN, 100, &rr.NS{"ns.example.com."}},
+		a("www.example.com.", 100, 2),
+		a("www.example.com.", 100, 3),
+		a("a.b.example.com.", 100, 4),
+		a("example.org.", 100, 5),
+	})
+
+	if n := c.FlushName("nonexistent.com."); n != 0 {
+		t.Fatal(10, n)
+	}
+
+	if n := c.FlushType("example.com.", rr.TYPE_NS); n != 1 {
+		t.Fatal(20, n, "!= 1")
+	}
+
+	found, hit := c.Get("example.com.")
+	if !hit || len(found) != 1 || found[0].Type != rr.TYPE_A {
+		t.Fatal(30, hit, found)
+	}
+
+	if n := c.FlushName("WWW.example.com."); n != 2 {
+		t.Fatal(40, n, "!= 2")
+	}
+
+	if found, hit = c.Get("www.example.com."); hit {
+		t.Fatal(50, found)
+	}
+
+	if n := c.FlushSubtree("example.com."); n != 2 {
+		t.Fatal(60, n, "!= 2")
+	}
+
+	for _, name := range []string{"example.com.", "a.b.example.com."} {
+		if found, hit = c.Get(name); hit {
+			t.Fatal(70, name, found)
+		}
+	}
+
+	if _, hit = c.Get("example.org."); !hit {
+		t.Fatal(80)
+	}
+}
+
+func TestPathName(t *testing.T) {
+	for i, test := range []struct {
+		path []string
+		name string
+	}{
+		{[]string{""}, "."},
+		{[]string{"", "com"}, "com."},
+		{[]string{"", "com", "example"}, "example.com."},
+		{[]string{"x"}, "x"},
+	} {
+		if g, e := pathName(test.path), test.name; g != e {
+			t.Fatal(i, g, e)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	c := New()
+	c.Add(rr.RRs{
+		a("www.example.com.", 100, 1),
+		{"example.com.", rr.TYPE_NS, rr.CLASS_IN, 100, &rr.NS{"ns.example.com."}},
+		{"x.example.com.", rr.TYPE_NXDOMAIN, rr.CLASS_IN, 100, &rr.NXDOMAIN{}},
+		{"y.example.com.", rr.TYPE_NODATA, rr.CLASS_IN, 100, &rr.NODATA{rr.TYPE_AAAA}},
+		a("example.org.", 100, 2),
+	})
+
+	var buf bytes.Buffer
+	if err := c.Dump(&buf, "example.com."); err != nil {
+		t.Fatal(10, err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if n := len(lines); n != 5 {
+		t.Fatal(20, n, "!= 5", buf.String())
+	}
+
+	for i, e := range []string{
+		"; cache dump",
+		"example.com.\tIN\t",
+		"www.example.com.\tIN\t",
+		"; x.example.com.\tIN\t",
+		"; y.example.com.\tIN\t",
+	} {
+		if g := lines[i]; !strings.HasPrefix(g, e) {
+			t.Fatal(30, i, g, e)
+		}
+	}
+
+	if g := lines[2]; !strings.HasSuffix(g, "A 1.1.1.1") {
+		t.Fatal(40, g)
+	}
+
+	if g := lines[4]; !strings.HasSuffix(g, "NODATA AAAA") {
+		t.Fatal(50, g)
+	}
+}
+
+func TestRank(t *testing.T) {
+	c := New()
+	ns := func(target string) *rr.RR {
+		return &rr.RR{"example.com.", rr.TYPE_NS, rr.CLASS_IN, 100, &rr.NS{target}}
+	}
+
+	c.AddRank(RankAuthAnswer, rr.RRs{a("ns.example.com.", 100, 1)})
+	c.AddRank(RankAdditional, rr.RRs{a("ns.example.com.", 100, 2)}) // glue must not overwrite the answer
+	found, hit := c.Get("ns.example.com.")
+	if !hit || len(found) != 1 || !found[0].RData.(*rr.A).Address.Equal(net.IPv4(1, 1, 1, 1)) {
+		t.Fatal(10, hit, found)
+	}
+
+	if rank, hit := c.Rank("ns.example.com.", rr.TYPE_A); !hit || rank != RankAuthAnswer {
+		t.Fatal(20, rank, hit)
+	}
+
+	c.AddRank(RankAdditional, rr.RRs{ns("a.ns.example.")})
+	c.AddRank(RankAdditional, rr.RRs{ns("b.ns.example.")}) // same rank merges
+	if found, hit = c.Get("example.com."); !hit || len(found) != 2 {
+		t.Fatal(30, hit, found)
+	}
+
+	c.AddRank(RankAuthority, rr.RRs{ns("c.ns.example.")}) // more credible data replaces
+	if found, hit = c.Get("example.com."); !hit || len(found) != 1 || found[0].RData.(*rr.NS).NSDName != "c.ns.example." {
+		t.Fatal(40, hit, found)
+	}
+
+	c.Add(rr.RRs{a("example.com.", 100, 3)}) // other types are independent
+	if rank, hit := c.Rank("example.com.", rr.TYPE_NS); !hit || rank != RankAuthority {
+		t.Fatal(50, rank, hit)
+	}
+
+	if rank, hit := c.Rank("example.com.", rr.TYPE_A); !hit || rank != RankNone {
+		t.Fatal(60, rank, hit)
+	}
+
+	if _, hit := c.Rank("example.com.", rr.TYPE_MX); hit {
+		t.Fatal(70)
+	}
+}
@@ -8,9 +8,13 @@
 package cache
 
 import (
+	"bufio"
+	"fmt"
 	"github.com/cznic/dns"
 	"github.com/cznic/dns/rr"
+	"io"
 	"math"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -24,51 +28,97 @@ func Secs0() int64 {
 	return atomic.LoadInt64(&secs0)
 }
 
-// Cache is a cache holding DNS RRs. Cache is organized as a dns.Tree.
-// Cache handles RR TTLs, expired RRs are removed as encountered.
-// Cache is safe for concurrent access.
+// Number of shards used by New. Must be a power of 2.
+const nshards = 64
+
+// entry is the datum stored in a shard tree.
+type entry struct {
+	data    rr.Bytes         // packed RRs, TTLs are relative to secs0
+	expires int32            // the earliest TTL in data, relative to secs0
+	ranks   map[rr.Type]Rank // RRset credibility, nil if all are RankNone
+}
+
+// shard is a part of Cache guarded by its own lock.
+type shard struct {
+	tree *dns.Tree
+	rwm  sync.RWMutex
+}
+
+// Cache is a cache holding DNS RRs. Cache is organized as a set of dns.Trees,
+// each guarded by its own lock. An owner name is always handled by the same
+// tree, selected by a hash of the name. Cache handles RR TTLs, expired RRs
+// are removed as encountered. Cache is safe for concurrent access.
 type Cache struct {
-	tree    *dns.Tree
-	rwm     sync.RWMutex
-	pending map[string]bool // removals
+	shards []shard
+	mask   uint32
+	policy atomic.Value // *policy
 }
 
 // New returns a newly created Cache.
 func New() *Cache {
-	return &Cache{tree: dns.NewTree(), pending: map[string]bool{}}
+	return newCache(nshards)
+}
+
+func newCache(n int) (c *Cache) {
+	c = &Cache{shards: make([]shard, n), mask: uint32(n - 1)}
+	for i := range c.shards {
+		c.shards[i].tree = dns.NewTree()
+	}
+	return
 }
 
-// Enum will enumerate Cache. Writers are blocked until Enum finishes.
+// shard returns the shard handling name. The hash is computed case
+// insensitively and without allocations (FNV-1a).
+func (c *Cache) shard(name string) *shard {
+	h := uint32(2166136261)
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		if b >= 'A' && b <= 'Z' {
+			b += 'a' - 'A'
+		}
+		h ^= uint32(b)
+		h *= 16777619
+	}
+	return &c.shards[h&c.mask]
+}
+
+// Enum will enumerate Cache. Writers of a shard are blocked while Enum
+// visits it.
 func (c *Cache) Enum(root string, handler func([]string, rr.Bytes) bool) {
-	c.rwm.RLock()         // R++
-	defer c.rwm.RUnlock() // R--
+	for i := range c.shards {
+		s := &c.shards[i]
+		if !s.enum(root, handler) {
+			return
+		}
+	}
+}
 
-	c.tree.Enum(root, func(path []string, data interface{}) bool {
+func (s *shard) enum(root string, handler func([]string, rr.Bytes) bool) (more bool) {
+	s.rwm.RLock()         // R++
+	defer s.rwm.RUnlock() // R--
+
+	more = true
+	s.tree.Enum(root, func(path []string, data interface{}) bool {
 		switch x := data.(type) {
-		case rr.Bytes:
-			return handler(path, x)
+		case *entry:
+			more = handler(path, x.data)
+			return more
 		}
 
 		return true
 	})
+	return
 }
 
 // Add will put or append RRs r into the cache owned by their rr.RR.Name.
-// RRs TTLs are interpreted as being relative to current time.
+// RRs TTLs are interpreted as being relative to current time. If a Policy is
+// set, RRs it rejects are not added and TTLs are clamped to its limits. The
+// added RRsets are of RankNone, see also AddRank.
 func (c *Cache) Add(rrs ...rr.RRs) {
-	owners := map[string]rr.RRs{}
-	for _, recs := range rrs {
-		for _, rec := range recs {
-			nm := strings.ToLower(rec.Name)
-			owners[nm] = append(owners[nm], rec)
-		}
-	}
-	for nm, rrs := range owners {
-		c.add(nm, rrs)
-	}
+	c.AddRank(RankNone, rrs...)
 }
 
-func (c *Cache) add(name string, rrs rr.RRs) {
+func (c *Cache) add(name string, rrs rr.RRs, rank Rank) {
 	newparts := rrs.Partition(true)
 	if tidy(0, newparts) && len(newparts) == 0 { // nothing left to add
 		return
@@ -76,29 +126,58 @@ func (c *Cache) add(name string, rrs rr.RRs) {
 
 	now := time.Now().Unix()
 	for _, part := range newparts {
-		for _, rec := range part {
-			rec.TTL = int32(now - secs0 + int64(rec.TTL))
+		for i, rec := range part { // rrs may be shared, don't modify them
+			x := *rec
+			x.TTL = int32(now - secs0 + int64(rec.TTL))
+			part[i] = &x
 		}
 	}
 
-	c.rwm.Lock()         // W++
-	defer c.rwm.Unlock() // W--
+	s := c.shard(name)
+	s.rwm.Lock()         // W++
+	defer s.rwm.Unlock() // W--
 
-	if oldparts, hit, _ := c.get0(name); hit {
-		newparts.SetAdd(oldparts)
+	parts, ranks, _, _ := s.get0(name, now)
+	if parts == nil {
+		parts = rr.Parts{}
 	}
-	c.tree.Put(name, newparts.Join().Pack())
+	s.put(name, parts, rank.merge(parts, ranks, newparts))
 }
 
-func tidy(dt int64, parts rr.Parts) (expired bool) {
-	for typ, part := range parts {
-		min := int32(math.MaxInt32)
-		for _, v := range part {
-			if ttl := v.TTL; ttl < min {
-				min = ttl
+// put stores parts owned by name and their ranks. s must be locked for
+// writing.
+func (s *shard) put(name string, parts rr.Parts, ranks map[rr.Type]Rank) {
+	if len(parts) == 0 {
+		s.tree.Delete(name)
+		return
+	}
+
+	var y map[rr.Type]Rank
+	for typ := range parts {
+		if r := ranks[typ]; r != RankNone {
+			if y == nil {
+				y = map[rr.Type]Rank{}
 			}
+			y[typ] = r
 		}
-		if int64(min) <= dt { // expired
+	}
+	rrs := parts.Join()
+	s.tree.Put(name, &entry{rrs.Pack(), minTTL(rrs), y})
+}
+
+func minTTL(rrs rr.RRs) (min int32) {
+	min = math.MaxInt32
+	for _, v := range rrs {
+		if ttl := v.TTL; ttl < min {
+			min = ttl
+		}
+	}
+	return
+}
+
+func tidy(dt int64, parts rr.Parts) (expired bool) {
+	for typ, part := range parts {
+		if int64(minTTL(part)) <= dt { // expired
 			delete(parts, typ)
 			expired = true
 		}
@@ -106,61 +185,229 @@ func tidy(dt int64, parts rr.Parts) (expired bool) {
 	return
 }
 
-func (c *Cache) get0(name string) (parts rr.Parts, hit, expired bool) {
-	var item rr.Bytes
-	if item, hit = c.tree.Get(name).(rr.Bytes); hit {
-		parts = item.Unpack().Partition(false)
-		expired = tidy(time.Now().Unix()-secs0, parts)
+// get0 returns the non expired parts owned by name and their ranks. s must be
+// locked.
+func (s *shard) get0(name string, now int64) (parts rr.Parts, ranks map[rr.Type]Rank, hit, expired bool) {
+	var e *entry
+	if e, hit = s.tree.Get(name).(*entry); hit {
+		ranks = e.ranks
+		parts = e.data.Unpack().Partition(false)
+		expired = tidy(now-secs0, parts)
 		hit = len(parts) != 0
 	}
 	return
 }
 
-func (c *Cache) get(name string) (parts rr.Parts, hit bool) {
-	expired := false
-	if parts, hit, expired = c.get0(name); hit {
-		if expired { // Schedule removal
-			go func() {
-				c.rwm.Lock()         // W++
-				defer c.rwm.Unlock() // W--
+// get returns the RRs owned by name, TTLs are still relative to secs0.
+func (s *shard) get(name string, now int64) (rrs rr.RRs, hit, expired bool) {
+	s.rwm.RLock()         // R++
+	defer s.rwm.RUnlock() // R--
 
-				if c.pending[name] { // P
-					return
-				}
+	e, ok := s.tree.Get(name).(*entry)
+	if !ok {
+		return
+	}
 
-				// !P && W
-				c.pending[name] = true                     // P++
-				defer func() { delete(c.pending, name) }() // P--
+	if int64(e.expires) > now-secs0 { // nothing expired yet, fast path
+		return e.data.Unpack(), true, false
+	}
 
-				if parts, hit, expired := c.get0(name); hit && expired {
-					if len(parts) != 0 {
-						c.tree.Put(name, parts.Join().Pack())
-						return
-					}
+	parts := e.data.Unpack().Partition(false)
+	tidy(now-secs0, parts)
+	return parts.Join(), len(parts) != 0, true
+}
 
-					c.tree.Delete(name)
-				}
-			}()
-		}
-	}
+// purge removes the expired RRs owned by name.
+func (s *shard) purge(name string, now int64) {
+	s.rwm.Lock()         // W++
+	defer s.rwm.Unlock() // W--
 
-	return
+	if parts, ranks, _, expired := s.get0(name, now); expired {
+		s.put(name, parts, ranks)
+	}
 }
 
 // Get will return rrs and true if non expired cached RRs owned by name are present in the cache.
-// If Get encounters expired RRs they are scheduled for removal and not returned.
+// If Get encounters expired RRs they are removed and not returned.
 func (c *Cache) Get(name string) (rrs rr.RRs, hit bool) {
-	c.rwm.RLock()         // R++
-	defer c.rwm.RUnlock() // R--
+	s := c.shard(name)
+	now := time.Now().Unix()
+	rrs, hit, expired := s.get(name, now)
+	if expired {
+		s.purge(name, now)
+	}
+
+	for _, v := range rrs {
+		v.TTL = int32(int64(v.TTL) + secs0 - now)
+	}
+	return
+}
+
+// FlushName removes all RRs owned by name from the cache. It returns the
+// number of RRs removed.
+func (c *Cache) FlushName(name string) (n int) {
+	return c.flush(name, func(rrs rr.RRs) (keep rr.RRs) {
+		return nil
+	})
+}
+
+// FlushType removes RRs of type t owned by name from the cache. It returns
+// the number of RRs removed.
+func (c *Cache) FlushType(name string, t rr.Type) (n int) {
+	return c.flush(name, func(rrs rr.RRs) (keep rr.RRs) {
+		_, keep = rrs.Filter(func(rec *rr.RR) bool {
+			return rec.Type == t
+		})
+		return
+	})
+}
+
+func (c *Cache) flush(name string, keep func(rr.RRs) rr.RRs) (n int) {
+	s := c.shard(name)
+	s.rwm.Lock()         // W++
+	defer s.rwm.Unlock() // W--
+
+	e, ok := s.tree.Get(name).(*entry)
+	if !ok {
+		return
+	}
+
+	rrs := e.data.Unpack()
+	kept := keep(rrs)
+	if n = len(rrs) - len(kept); n != 0 {
+		s.put(name, kept.Partition(false), e.ranks)
+	}
+	return
+}
+
+// FlushSubtree removes all RRs owned by root and by all names below root from
+// the cache, e.g. FlushSubtree("example.com.") removes also RRs owned by
+// "www.example.com.". It returns the number of RRs removed.
+func (c *Cache) FlushSubtree(root string) (n int) {
+	for i := range c.shards {
+		n += c.shards[i].flushSubtree(root)
+	}
+	return
+}
+
+func (s *shard) flushSubtree(root string) (n int) {
+	s.rwm.Lock()         // W++
+	defer s.rwm.Unlock() // W--
+
+	var names []string
+	s.tree.Enum(root, func(path []string, data interface{}) bool {
+		if e, ok := data.(*entry); ok {
+			names = append(names, pathName(path))
+			n += len(e.data.Unpack())
+		}
+		return true
+	})
+	for _, name := range names {
+		s.tree.Delete(name)
+	}
+	return
+}
+
+// pathName returns the domain name of a dns.Tree path.
+func pathName(path []string) string {
+	rooted := len(path) != 0 && path[0] == ""
+	if rooted {
+		path = path[1:]
+	}
+
+	a := make([]string, len(path))
+	for i, label := range path {
+		a[len(path)-1-i] = label
+	}
+	name := strings.Join(a, ".")
+	if rooted {
+		name += "."
+	}
+	return name
+}
 
-	var parts rr.Parts
+type dumpItem struct {
+	path []string
+	rrs  rr.RRs
+}
+
+type dumpItems []dumpItem
+
+// Implementation of sort.Interface
+func (d dumpItems) Len() int {
+	return len(d)
+}
+
+// Implementation of sort.Interface
+func (d dumpItems) Less(i, j int) bool {
+	a, b := d[i].path, d[j].path
+	for k := 0; k < len(a) && k < len(b); k++ {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// Implementation of sort.Interface
+func (d dumpItems) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+}
+
+// Dump writes the non expired RRs owned by root and by all names below root
+// to w in the RFC 1035 master file format. The TTLs written are the remaining
+// TTLs. Negative cache entries (rr.TYPE_NXDOMAIN, rr.TYPE_NODATA) have no
+// master file representation, they are written as comments. Owner names are
+// written in the hierarchical order.
+func (c *Cache) Dump(w io.Writer, root string) (err error) {
 	now := time.Now().Unix()
-	if parts, hit = c.get(name); hit {
-		rrs = parts.Join()
-		for _, v := range rrs {
-			v.TTL = int32(int64(v.TTL) + secs0 - now)
+	var items dumpItems
+	c.Enum(root, func(path []string, data rr.Bytes) bool {
+		parts := data.Unpack().Partition(false)
+		tidy(now-secs0, parts)
+		if rrs := parts.Join(); len(rrs) != 0 {
+			items = append(items, dumpItem{append([]string(nil), path...), rrs})
 		}
+		return true
+	})
+	sort.Sort(items)
+
+	b := bufio.NewWriter(w)
+	if _, err = fmt.Fprintf(b, "; cache dump of %q at %s\n", root, time.Unix(now, 0).UTC().Format(time.RFC3339)); err != nil {
+		return
 	}
 
-	return
+	for _, item := range items {
+		rrs := item.rrs
+		sort.Sort(byType(rrs))
+		for _, rec := range rrs {
+			rec.TTL = int32(int64(rec.TTL) + secs0 - now)
+			s := rec.String()
+			switch rec.Type {
+			case rr.TYPE_NXDOMAIN, rr.TYPE_NODATA:
+				s = "; " + strings.TrimSpace(s)
+			}
+			if _, err = fmt.Fprintln(b, s); err != nil {
+				return
+			}
+		}
+	}
+	return b.Flush()
+}
+
+type byType rr.RRs
+
+// Implementation of sort.Interface
+func (b byType) Len() int {
+	return len(b)
+}
+
+// Implementation of sort.Interface
+func (b byType) Less(i, j int) bool {
+	return b[i].Type < b[j].Type
+}
+
+// Implementation of sort.Interface
+func (b byType) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
 }
@@ -0,0 +1,128 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package cache
+
+import (
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/rr"
+)
+
+// TypePolicy overrides a Policy for RRs of a particular rr.Type.
+type TypePolicy struct {
+	// Never cache RRs of this type.
+	NoCache bool
+	// If non zero, overrides Policy.MinTTL or Policy.NegMinTTL.
+	MinTTL int32
+	// If non zero, overrides Policy.MaxTTL or Policy.NegMaxTTL.
+	MaxTTL int32
+}
+
+// Policy controls which RRs Cache.Add accepts and for how long they are
+// kept. Zero values of the TTL limits mean no limit. RRs with a TTL <= 0 are
+// never cached regardless of the minimal TTLs.
+type Policy struct {
+	// TTL limits of positive entries.
+	MinTTL, MaxTTL int32
+	// TTL limits of negative entries, i.e. rr.TYPE_NXDOMAIN and
+	// rr.TYPE_NODATA.
+	NegMinTTL, NegMaxTTL int32
+	// Per type overrides. Cache.Add never sees the QTYPE of the query the
+	// RRs are answering, an entry for rr.Type(msg.QTYPE_STAR) is thus
+	// only reported by Cacheable for the callers to consult.
+	Types map[rr.Type]TypePolicy
+	// Domains for which nothing is cached. A domain covers also all of
+	// its subdomains.
+	NoCache []string
+}
+
+// Cacheable returns whether RRs of type t may be cached under p.
+func (p *Policy) Cacheable(t rr.Type) bool {
+	return !p.Types[t].NoCache
+}
+
+// ttl returns TTL of rec clamped according to p.
+func (p *Policy) ttl(rec *rr.RR) (ttl int32) {
+	ttl = rec.TTL
+	min, max := p.MinTTL, p.MaxTTL
+	switch rec.Type {
+	case rr.TYPE_NXDOMAIN, rr.TYPE_NODATA:
+		min, max = p.NegMinTTL, p.NegMaxTTL
+	}
+	if tp, ok := p.Types[rec.Type]; ok {
+		if tp.MinTTL != 0 {
+			min = tp.MinTTL
+		}
+		if tp.MaxTTL != 0 {
+			max = tp.MaxTTL
+		}
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	if ttl < min {
+		ttl = min
+	}
+	if max != 0 && ttl > max {
+		ttl = max
+	}
+	return
+}
+
+// policy is a Policy prepared for use by Cache.Add.
+type policy struct {
+	*Policy
+	nocache *dns.Tree
+}
+
+func newPolicy(p *Policy) (y *policy) {
+	y = &policy{Policy: p, nocache: dns.NewTree()}
+	for _, domain := range p.NoCache {
+		y.nocache.Put(dns.RootedName(domain), true)
+	}
+	return
+}
+
+// filter returns the RRs of rrs which may be cached, with clamped TTLs. The
+// RRs in rrs are not modified.
+func (p *policy) filter(rrs rr.RRs) (y rr.RRs) {
+	for _, rec := range rrs {
+		if !p.Cacheable(rec.Type) || p.nocache.Match(rec.Name) != nil {
+			continue
+		}
+
+		if ttl := p.ttl(rec); ttl != rec.TTL {
+			x := *rec
+			x.TTL = ttl
+			rec = &x
+		}
+		y = append(y, rec)
+	}
+	return
+}
+
+// SetPolicy sets the Policy applied by Add. A nil p removes any Policy.
+// Entries already in the cache are not affected. The Policy must not be
+// modified after SetPolicy.
+func (c *Cache) SetPolicy(p *Policy) {
+	if p == nil {
+		c.policy.Store((*policy)(nil))
+		return
+	}
+
+	c.policy.Store(newPolicy(p))
+}
+
+// Policy returns the Policy set by SetPolicy or nil if there is none.
+func (c *Cache) Policy() *Policy {
+	if p, _ := c.policy.Load().(*policy); p != nil {
+		return p.Policy
+	}
+
+	return nil
+}
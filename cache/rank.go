@@ -0,0 +1,133 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package cache
+
+import (
+	"github.com/cznic/dns/rr"
+	"strings"
+	"time"
+)
+
+// Rank is the credibility of cached data (rfc2181/5.4.1). Cache keeps a Rank
+// per RRset, i.e. per owner name and rr.Type.
+type Rank int
+
+// Values of Rank, from the least to the most trustworthy.
+const (
+	// Data added by Add. RRsets of this rank are only merged with each
+	// other, any ranked data replaces them.
+	RankNone Rank = iota
+	// Additional information from any answer and data from the
+	// authority section of a non authoritative answer.
+	RankAdditional
+	// Data from the answer section of a non authoritative answer.
+	RankAnswer
+	// Glue from a primary zone, or glue from a zone transfer.
+	RankGlue
+	// Data from the authority section of an authoritative answer.
+	RankAuthority
+	// The authoritative data included in the answer section of an
+	// authoritative reply.
+	RankAuthAnswer
+	// Data from a primary zone file, other than glue data, or data from a
+	// zone transfer, other than glue.
+	RankZone
+)
+
+var rankNames = map[Rank]string{
+	RankNone:       "RankNone",
+	RankAdditional: "RankAdditional",
+	RankAnswer:     "RankAnswer",
+	RankGlue:       "RankGlue",
+	RankAuthority:  "RankAuthority",
+	RankAuthAnswer: "RankAuthAnswer",
+	RankZone:       "RankZone",
+}
+
+func (r Rank) String() (s string) {
+	var ok bool
+	if s, ok = rankNames[r]; !ok {
+		s = "Rank?"
+	}
+	return
+}
+
+// AddRank is like Add but the added RRsets are of credibility rank. A cached,
+// non expired RRset of a higher rank is not replaced nor merged with, an
+// RRset of a lower rank is replaced. RRsets of the same rank are merged as by
+// Add.
+func (c *Cache) AddRank(rank Rank, rrs ...rr.RRs) {
+	p, _ := c.policy.Load().(*policy)
+	owners := map[string]rr.RRs{}
+	for _, recs := range rrs {
+		if p != nil {
+			recs = p.filter(recs)
+		}
+		for _, rec := range recs {
+			nm := strings.ToLower(rec.Name)
+			owners[nm] = append(owners[nm], rec)
+		}
+	}
+	for nm, rrs := range owners {
+		c.add(nm, rrs, rank)
+	}
+}
+
+// merge merges newparts of rank into parts of ranks and returns the updated
+// ranks.
+func (rank Rank) merge(parts rr.Parts, ranks map[rr.Type]Rank, newparts rr.Parts) map[rr.Type]Rank {
+	for typ, recs := range newparts {
+		old, ok := parts[typ]
+		switch r := ranks[typ]; {
+		case !ok || r < rank:
+			parts[typ] = recs
+		case r == rank:
+			recs.SetAdd(old) // more recent add wins on equality
+			parts[typ] = recs
+		default: // keep the more credible data
+			continue
+		}
+
+		if rank == RankNone {
+			delete(ranks, typ)
+			continue
+		}
+
+		if ranks == nil {
+			ranks = map[rr.Type]Rank{}
+		}
+		ranks[typ] = rank
+	}
+	return ranks
+}
+
+// Rank returns the credibility rank of the non expired RRset of type t owned
+// by name and whether there is such RRset in the cache.
+func (c *Cache) Rank(name string, t rr.Type) (rank Rank, hit bool) {
+	s := c.shard(name)
+	s.rwm.RLock()         // R++
+	defer s.rwm.RUnlock() // R--
+
+	e, ok := s.tree.Get(name).(*entry)
+	if !ok {
+		return
+	}
+
+	now := time.Now().Unix() - secs0
+	for _, rec := range e.data.Unpack() {
+		if rec.Type != t {
+			continue
+		}
+
+		if int64(rec.TTL) <= now { // the RRset has expired
+			return 0, false
+		}
+
+		rank, hit = e.ranks[t], true
+	}
+	return
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package doh
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func echo(query *msg.Message, remote net.Addr) *msg.Message {
+	query.QR = true
+	query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 300, &rr.A{net.IPv4(192, 0, 2, 1)}}}
+	query.Authority = rr.RRs{&rr.RR{"example.com.", rr.TYPE_SOA, rr.CLASS_IN, 3600, &rr.SOA{"ns.example.com.", "hostmaster.example.com.", 1, 2, 3, 4, 60}}}
+	return query
+}
+
+func TestExchange(t *testing.T) {
+	srv := httptest.NewUnstartedServer(&Handler{msg.ResponderFunc(echo)})
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i, get := range []bool{false, true} {
+		c := NewHTTPClient(srv.URL+"/dns-query", srv.Client())
+		c.GET = get
+		m := msg.New()
+		m.Question.A("www.example.com.", rr.CLASS_IN)
+		reply, err := c.Exchange(ctx, m)
+		if err != nil {
+			t.Fatal(10, i, err)
+		}
+
+		if reply.ID != m.ID || !reply.QR || len(reply.Answer) != 1 || reply.Question[0].QNAME != "www.example.com." {
+			t.Fatal(20, i, reply)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	h := &Handler{msg.ResponderFunc(echo)}
+	m := msg.New()
+	m.Question.A("www.example.com.", rr.CLASS_IN)
+	wb := dns.NewWirebuf()
+	m.Encode(wb)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(wb.Buf), nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != ContentType {
+		t.Fatal(10, w.Code, w.Header())
+	}
+
+	if g, e := w.Header().Get("Cache-Control"), "max-age=60"; g != e {
+		t.Fatal(20, g, e)
+	}
+
+	for i, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/dns-query", nil),
+		httptest.NewRequest(http.MethodGet, "/dns-query?dns=!!", nil),
+		httptest.NewRequest(http.MethodGet, "/dns-query?dns=AAAA", nil),
+		httptest.NewRequest(http.MethodPut, "/dns-query", nil),
+		httptest.NewRequest(http.MethodPost, "/dns-query", nil),
+	} {
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		if w.Code == http.StatusOK {
+			t.Fatal(30, i)
+		}
+	}
+
+	if ttl, ok := MaxAge(msg.New()); ok || ttl != 0 {
+		t.Fatal(40, ttl, ok)
+	}
+}
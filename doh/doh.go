@@ -0,0 +1,243 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+// Package doh supports DNS queries over HTTPS (rfc8484).
+//
+// Handler is an http.Handler serving the DNS wire format over GET and POST
+// requests, Client performs exchanges with such a server over HTTP/2.
+package doh
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of DNS messages (rfc8484/6).
+const ContentType = "application/dns-message"
+
+// maxMsgSize is the largest DNS message accepted.
+const maxMsgSize = math.MaxUint16
+
+// Handler is an http.Handler answering DNS queries sent by rfc8484 GET
+// requests, having the query in the base64url encoded "dns" parameter, and by
+// POST requests, having the query as the body. The queries are answered by
+// the Responder. Replies are sent with a Cache-Control max-age of the
+// smallest TTL in their answer and authority sections (rfc8484/5.1).
+type Handler struct {
+	Responder msg.Responder
+}
+
+// httpAddr is the net.Addr of an HTTP client passed to a Responder, its
+// String is the RemoteAddr of the request.
+type httpAddr string
+
+// Network implements net.Addr.
+func (a httpAddr) Network() string {
+	return "https"
+}
+
+// String implements net.Addr.
+func (a httpAddr) String() string {
+	return string(a)
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var b []byte
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		s := r.URL.Query().Get("dns")
+		if s == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+
+		if b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "=")); err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != ContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		if b, err = io.ReadAll(io.LimitReader(r.Body, maxMsgSize+1)); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(b) > maxMsgSize {
+			http.Error(w, "message too long", http.StatusRequestEntityTooLarge)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := &msg.Message{}
+	p := 0
+	if err = query.Decode(b, &p, nil); err != nil {
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	reply := h.Responder.Respond(query, httpAddr(r.RemoteAddr))
+	if reply == nil {
+		http.Error(w, "no reply", http.StatusBadGateway)
+		return
+	}
+
+	wb := dns.NewWirebuf()
+	reply.Encode(wb)
+	hdr := w.Header()
+	hdr.Set("Content-Type", ContentType)
+	hdr.Set("Content-Length", strconv.Itoa(len(wb.Buf)))
+	if ttl, ok := MaxAge(reply); ok {
+		hdr.Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(wb.Buf)
+}
+
+// MaxAge returns the freshness lifetime of m, i.e. the smallest TTL of the
+// RRs in its answer and authority sections, taking the SOA minimum into
+// account (rfc2308/5). The returned ok is false if m has no such RRs.
+func MaxAge(m *msg.Message) (ttl int32, ok bool) {
+	ttl = math.MaxInt32
+	for _, part := range []rr.RRs{m.Answer, m.Authority} {
+		for _, rec := range part {
+			t := rec.TTL
+			if soa, isSOA := rec.RData.(*rr.SOA); isSOA && int32(soa.Minimum) < t {
+				t = int32(soa.Minimum)
+			}
+			if t < ttl {
+				ttl = t
+			}
+			ok = true
+		}
+	}
+	if !ok || ttl < 0 {
+		ttl = 0
+	}
+	return
+}
+
+// Client exchanges DNS messages with a DoH server. Client is safe for
+// concurrent use.
+type Client struct {
+	url  string
+	http *http.Client
+	// If GET is true, queries are sent by GET requests, which are
+	// cacheable by HTTP caches, otherwise by POST requests.
+	GET bool
+}
+
+// NewClient returns a Client of the DoH server at the URI template
+// rawURL, e.g. "https://dns.example.com/dns-query". The TLS configuration is
+// taken from config, which may be nil. Requests are sent over HTTP/2 when the
+// server supports it.
+func NewClient(rawURL string, config *tls.Config) (c *Client, err error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("doh.NewClient: unsupported URL scheme %q", u.Scheme)
+	}
+
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = config
+	t.ForceAttemptHTTP2 = true
+	return NewHTTPClient(rawURL, &http.Client{Transport: t}), nil
+}
+
+// NewHTTPClient returns a Client of the DoH server at rawURL using hc for
+// the requests.
+func NewHTTPClient(rawURL string, hc *http.Client) *Client {
+	return &Client{url: rawURL, http: hc}
+}
+
+// URL returns the URL of the server of c.
+func (c *Client) URL() string {
+	return c.url
+}
+
+// Exchange sends m to the server and returns its reply. The query is sent
+// with ID zero (rfc8484/4.1), the ID of the reply is set to m.ID. m is not
+// modified. The exchange is bounded by ctx.
+func (c *Client) Exchange(ctx context.Context, m *msg.Message) (reply *msg.Message, err error) {
+	q := *m
+	q.ID = 0
+	wb := dns.NewWirebuf()
+	q.Encode(wb)
+
+	var req *http.Request
+	switch {
+	case c.GET:
+		u := c.url + "?dns=" + base64.RawURLEncoding.EncodeToString(wb.Buf)
+		if strings.Contains(c.url, "?") {
+			u = c.url + "&dns=" + base64.RawURLEncoding.EncodeToString(wb.Buf)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	default:
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(wb.Buf)); err == nil {
+			req.Header.Set("Content-Type", ContentType)
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	req.Header.Set("Accept", ContentType)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("doh: %s: %s", c.url, resp.Status)
+	}
+
+	if ct := resp.Header.Get("Content-Type"); ct != ContentType {
+		return nil, fmt.Errorf("doh: %s: unexpected content type %q", c.url, ct)
+	}
+
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxMsgSize+1))
+	if err != nil {
+		return
+	}
+
+	if len(b) > maxMsgSize {
+		return nil, fmt.Errorf("doh: %s: reply too long", c.url)
+	}
+
+	reply = &msg.Message{}
+	p := 0
+	if err = reply.Decode(b, &p, nil); err != nil {
+		return nil, err
+	}
+
+	reply.ID = m.ID
+	return
+}
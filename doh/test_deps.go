@@ -0,0 +1,13 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package doh
+
+// Pull test dependencies too.
+// Enables easy 'go test X' after 'go get X'
+import (
+// nothing yet
+)
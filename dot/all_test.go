@@ -0,0 +1,184 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package dot
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a self-signed certificate for 127.0.0.1.
+func selfSigned(t *testing.T) (cert tls.Certificate, x *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "dot test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if x, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, x
+}
+
+func echo(query *msg.Message, remote net.Addr) *msg.Message {
+	query.QR = true
+	query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 1)}}}
+	return query
+}
+
+func serve(t *testing.T) (addr string, x *x509.Certificate, stop func()) {
+	cert, x := selfSigned(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Config: &tls.Config{Certificates: []tls.Certificate{cert}}, Responder: msg.ResponderFunc(echo)}
+	go s.Serve(l)
+	return l.Addr().String(), x, func() { l.Close() }
+}
+
+func TestExchange(t *testing.T) {
+	addr, x, stop := serve(t)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(x)
+	c := NewClient(addr, &tls.Config{RootCAs: pool})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			m := msg.New()
+			m.Question.A("example.com.", rr.CLASS_IN)
+			reply, err := c.Exchange(ctx, m)
+			if err == nil && (reply.ID != m.ID || len(reply.Answer) != 1) {
+				t.Error(reply)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(10, err)
+		}
+	}
+
+	// The server closed connection is replaced transparently.
+	c.conn.Close()
+	m := msg.New()
+	m.Question.A("example.com.", rr.CLASS_IN)
+	if _, err := c.Exchange(ctx, m); err != nil {
+		t.Fatal(20, err)
+	}
+
+	if _, err := NewClient(addr, nil).Exchange(ctx, m); err == nil {
+		t.Fatal(30, "self-signed certificate accepted")
+	}
+}
+
+func TestPin(t *testing.T) {
+	addr, x, stop := serve(t)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := msg.New()
+	m.Question.A("example.com.", rr.CLASS_IN)
+	c := NewClient(addr, &tls.Config{InsecureSkipVerify: true}, make([]byte, 32), Pin(x))
+	if _, err := c.Exchange(ctx, m); err != nil {
+		t.Fatal(10, err)
+	}
+
+	c.Close()
+	c = NewClient(addr, &tls.Config{InsecureSkipVerify: true}, make([]byte, 32))
+	if _, err := c.Exchange(ctx, m); err == nil {
+		t.Fatal(20, "pin mismatch accepted")
+	}
+}
+
+func TestDialing(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	defer l.Close()
+
+	conns := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept() // and never complete the handshake
+		if err == nil {
+			conns <- c
+		}
+	}()
+
+	m := msg.New()
+	m.Question.A("example.com.", rr.CLASS_IN)
+	c := NewClient(l.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	first := make(chan error)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		_, err := c.Exchange(ctx, m)
+		first <- err
+	}()
+	conn := <-conns
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	t0 := time.Now()
+	if _, err := c.Exchange(ctx, m); err != context.DeadlineExceeded || time.Since(t0) > 5*time.Second {
+		t.Fatal(20, err, time.Since(t0))
+	}
+
+	c.Close()
+	conn.Close()
+	if err := <-first; err == nil {
+		t.Fatal(30)
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+// Package dot supports DNS over TLS (rfc7858).
+//
+// Messages are exchanged over a *tls.Conn using the same 2 byte length
+// prefixed framing as DNS over TCP. A Client keeps its connection open and
+// pipelines concurrent exchanges over it, a Server answers the queries of a
+// connection concurrently.
+package dot
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/cznic/dns/msg"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Port is the DNS over TLS port (rfc7858/3.1).
+const Port = 853
+
+// DefaultIdleTimeout is the Server IdleTimeout used if none is set.
+const DefaultIdleTimeout = 10 * time.Second
+
+// ErrPin is returned when no certificate presented by a server matches any
+// of the SPKI pins of a Client.
+var ErrPin = errors.New("dot: no SPKI pin matches the server certificates")
+
+// Pin returns the SPKI pin of cert, i.e. the SHA-256 digest of its DER
+// encoded SubjectPublicKeyInfo (rfc7858/4.2, rfc7469/2.4).
+func Pin(cert *x509.Certificate) []byte {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return sum[:]
+}
+
+// Client exchanges DNS messages with a DNS over TLS server. The connection is
+// established by the first Exchange and reused by the following ones,
+// concurrent exchanges are pipelined. If the connection fails, e.g. because
+// the server closed it when idle, the next Exchange establishes a new one.
+// Client is safe for concurrent use.
+type Client struct {
+	addr    string
+	closes  int // number of Close invocations
+	config  *tls.Config
+	conn    *msg.StreamConn
+	dialing chan struct{} // non nil while the connection is being dialed
+	lock    sync.Mutex
+}
+
+// NewClient returns a Client of the server at addr, "host:port" or just
+// "host" for the default Port. The TLS configuration is taken from config,
+// which may be nil. If any pins are given, at least one of the certificates
+// presented by the server must match one of them, in addition to whatever
+// verification config asks for. To rely on the pins only, set
+// InsecureSkipVerify in config (rfc7858/4.2).
+func NewClient(addr string, config *tls.Config, pins ...[]byte) *Client {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(Port))
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12 // rfc8310/9
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	if len(pins) != 0 {
+		pins = append([][]byte(nil), pins...)
+		verify := config.VerifyConnection
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+
+			for _, cert := range cs.PeerCertificates {
+				pin := Pin(cert)
+				for _, v := range pins {
+					if bytes.Equal(pin, v) {
+						return nil
+					}
+				}
+			}
+			return ErrPin
+		}
+	}
+	return &Client{addr: addr, config: config}
+}
+
+// Addr returns the address of the server of c.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+// stream returns the connection of c, establishing it if necessary. The
+// returned reused reports whether the connection was already established.
+// Only one connection is dialed at a time, other callers wait for it bounded
+// by their own ctx.
+func (c *Client) stream(ctx context.Context) (conn *msg.StreamConn, reused bool, err error) {
+	for {
+		c.lock.Lock() // X++
+		if c.conn != nil && c.conn.Err() == nil {
+			conn = c.conn
+			c.lock.Unlock() // X--
+			return conn, true, nil
+		}
+
+		if ch := c.dialing; ch != nil {
+			c.lock.Unlock() // X--
+			select {
+			case <-ch:
+				continue
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}
+
+		ch := make(chan struct{})
+		c.dialing = ch
+		closes := c.closes
+		c.lock.Unlock() // X--
+
+		d := tls.Dialer{Config: c.config}
+		nc, err := d.DialContext(ctx, "tcp", c.addr)
+
+		c.lock.Lock() // X++
+		c.dialing = nil
+		close(ch)
+		switch {
+		case err != nil:
+		case c.closes != closes: // Close was called while dialing
+			nc.Close()
+			err = msg.ErrStreamClosed
+		default:
+			c.conn = msg.NewStreamConn(nc)
+			conn = c.conn
+		}
+		c.lock.Unlock() // X--
+		return conn, false, err
+	}
+}
+
+// Exchange sends m to the server and returns its reply. The exchange,
+// including establishing the connection, is bounded by ctx. m is not
+// modified, see msg.StreamConn.Exchange for how the query and reply IDs are
+// handled.
+func (c *Client) Exchange(ctx context.Context, m *msg.Message) (reply *msg.Message, err error) {
+	for {
+		conn, reused, err := c.stream(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		if reply, err = conn.Exchange(ctx, m); err == nil || !reused || ctx.Err() != nil || conn.Err() == nil {
+			return reply, err
+		}
+
+		// The reused connection failed, most probably it was closed by
+		// the server. Try once more with a new one.
+	}
+}
+
+// Close closes the connection of c, if any. Exchanges in progress fail.
+func (c *Client) Close() (err error) {
+	c.lock.Lock()         // X++
+	defer c.lock.Unlock() // X--
+
+	c.closes++
+	if c.conn != nil {
+		err = c.conn.Close()
+		c.conn = nil
+	}
+	return
+}
+
+// Server is a DNS over TLS server.
+type Server struct {
+	// Config must provide the server certificate.
+	Config *tls.Config
+	// Responder answers the queries.
+	Responder msg.Responder
+	// A connection is closed when no query arrives for IdleTimeout
+	// (rfc7858/3.4). Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+}
+
+// Serve accepts TCP connections from l and serves DNS over TLS on them. Serve
+// returns when l.Accept fails, e.g. because l was closed.
+func (s *Server) Serve(l net.Listener) error {
+	idle := s.IdleTimeout
+	if idle == 0 {
+		idle = DefaultIdleTimeout
+	}
+	tl := tls.NewListener(l, s.Config)
+	for {
+		c, err := tl.Accept()
+		if err != nil {
+			return err
+		}
+
+		go msg.ServeStream(c, s.Responder, idle)
+	}
+}
+
+// ListenAndServe listens on the TCP address addr, ":853" if addr is empty,
+// and invokes Serve.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = ":" + strconv.Itoa(Port)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	defer l.Close()
+	return s.Serve(l)
+}
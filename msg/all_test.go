@@ -7,10 +7,15 @@
 package msg
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/cznic/dns"
 	"github.com/cznic/dns/rr"
+	"io"
 	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -222,3 +227,412 @@ func TestExchange3(t *testing.T) {
 
 	t.Log(re.Message)
 }
+
+func TestExchangeTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		defer c.Close()
+		m := &Message{}
+		if _, err := m.ReceiveTCP(c.(*net.TCPConn), make([]byte, 512)); err != nil {
+			return
+		}
+
+		m.QR = true
+		m.Send(c)
+	}()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	m := New()
+	m.Question.A("example.com.", rr.CLASS_IN)
+	reply, err := m.Exchange(c, 512)
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	if reply.ID != m.ID || !reply.QR || reply.Question.String() != m.Question.String() {
+		t.Fatal(40, reply)
+	}
+}
+
+func TestStreamConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	defer ln.Close()
+
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+
+		ServeStream(c, ResponderFunc(func(query *Message, remote net.Addr) *Message {
+			if strings.HasPrefix(query.Question[0].QNAME, "slow.") {
+				time.Sleep(100 * time.Millisecond) // reply out of order
+			}
+			query.QR = true
+			return query
+		}), time.Second)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	c := NewStreamConn(conn)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	names := []string{"slow.example.com.", "a.example.com.", "b.example.com.", "c.example.com."}
+	errs := make(chan error, len(names))
+	order := make(chan string, len(names))
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			m := New()
+			m.ID = 42 // the same for all, the wire IDs must differ
+			m.Question.A(name, rr.CLASS_IN)
+			reply, err := c.Exchange(ctx, m)
+			switch {
+			case err != nil:
+				errs <- err
+			case m.ID != 42 || reply.ID != 42 || reply.Question[0].QNAME != name:
+				errs <- fmt.Errorf("%s: bad reply %s", name, reply)
+			default:
+				order <- name
+			}
+		}(name)
+	}
+	wg.Wait()
+	close(errs)
+	close(order)
+	for err := range errs {
+		t.Fatal(30, err)
+	}
+
+	var last string
+	for last = range order {
+	}
+	if last != names[0] {
+		t.Fatal(40, last)
+	}
+
+	c.Close()
+	if _, err := c.Exchange(ctx, New()); err != ErrStreamClosed {
+		t.Fatal(50, err)
+	}
+}
+
+// sample returns the wire format of a reply with RRs of several types.
+func sample() []byte {
+	m := New()
+	m.QR, m.AA = true, true
+	m.Question.A("www.example.com.", rr.CLASS_IN)
+	m.Answer = rr.RRs{
+		&rr.RR{"www.example.com.", rr.TYPE_CNAME, rr.CLASS_IN, 3600, &rr.CNAME{"example.com."}},
+		&rr.RR{"example.com.", rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 1)}},
+	}
+	m.Authority = rr.RRs{
+		&rr.RR{"example.com.", rr.TYPE_NS, rr.CLASS_IN, 3600, &rr.NS{"ns.example.com."}},
+		&rr.RR{"example.com.", rr.TYPE_SOA, rr.CLASS_IN, 3600, &rr.SOA{"ns.example.com.", "hostmaster.example.com.", 1, 3600, 600, 86400, 300}},
+		&rr.RR{"example.com.", rr.TYPE_MX, rr.CLASS_IN, 3600, &rr.MX{10, "mail.example.com."}},
+		&rr.RR{"example.com.", rr.TYPE_TXT, rr.CLASS_IN, 3600, &rr.TXT{[]string{"v=spf1 -all"}}},
+	}
+	m.Additional = rr.RRs{
+		&rr.RR{"ns.example.com.", rr.TYPE_AAAA, rr.CLASS_IN, 3600, &rr.AAAA{net.ParseIP("2001:db8::1")}},
+		&rr.RR{".", rr.TYPE_OPT, rr.Class(4096), 0, &rr.OPT{[]rr.OPT_DATA{{10, []byte{1, 2, 3, 4, 5, 6, 7, 8}}}}},
+	}
+	w := dns.NewWirebuf()
+	m.Encode(w)
+	return w.Buf
+}
+
+func TestDecodeError(t *testing.T) {
+	b := sample()
+	m := &Message{}
+	p := 0
+	if err := m.Decode(b, &p, nil); err != nil {
+		t.Fatal(10, err)
+	}
+
+	answer := 12 + len("\x03www\x07example\x03com\x00") + 4
+	loop := append([]byte(nil), b[:answer]...)
+	loop = append(loop, 0xC0, byte(answer), 0, 1, 0, 1, 0, 0, 0, 0, 0, 0)
+	copy(loop[6:], []byte{0, 1, 0, 0, 0, 0}) // ANCOUNT 1
+	ancount := append([]byte(nil), b...)
+	ancount[7] = 0xff
+	for i, test := range []struct {
+		b       []byte
+		section string
+		ofs     int
+		err     error
+	}{
+		{b[:5], "header", 4, dns.ErrUnderflow},
+		{ancount, "header", 0, dns.ErrCount},
+		{append(b[:len(b):len(b)], 0), "", len(b), dns.ErrTrailing},
+		{loop, "answer", answer, dns.ErrPointer},
+		{b[:len(b)-1], "additional", len(b) - 12 - 2, dns.ErrRDLength},
+	} {
+		m := &Message{}
+		p := 0
+		err := m.Decode(test.b, &p, nil)
+		e, ok := err.(*dns.DecodeError)
+		if !ok || !errors.Is(err, test.err) || e.Section != test.section || e.Offset != test.ofs {
+			t.Fatal(20, i, err, test.err, test.section, test.ofs)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	f.Add(sample())
+	f.Add([]byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		m := &Message{}
+		p := 0
+		if err := m.Decode(b, &p, nil); err != nil {
+			if _, ok := err.(*dns.DecodeError); !ok {
+				t.Fatal(10, err)
+			}
+			return
+		}
+
+		if p != len(b) {
+			t.Fatal(20, p, len(b))
+		}
+
+		var ps Parser
+		if err := ps.Start(b); err != nil {
+			t.Fatal(30, err)
+		}
+
+		n := 0
+		for {
+			r, err := ps.Next()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				t.Fatal(40, err)
+			}
+
+			if r.Section != SectionQuestion {
+				if _, err = r.RR(); err != nil {
+					t.Fatal(50, err)
+				}
+			}
+			n++
+		}
+		if g, e := n, len(m.Question)+len(m.Answer)+len(m.Authority)+len(m.Additional); g != e {
+			t.Fatal(60, g, e)
+		}
+	})
+}
+
+func TestParser(t *testing.T) {
+	b := sample()
+	m := &Message{}
+	p := 0
+	if err := m.Decode(b, &p, nil); err != nil {
+		t.Fatal(10, err)
+	}
+
+	var ps Parser
+	if err := ps.Start(b); err != nil {
+		t.Fatal(20, err)
+	}
+
+	if g, e := ps.Header, m.Header; g != e {
+		t.Fatal(30, g, e)
+	}
+
+	var recs []Record
+	for {
+		r, err := ps.Next()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			t.Fatal(40, err)
+		}
+
+		recs = append(recs, r)
+	}
+
+	if g, e := len(recs), 1+len(m.Answer)+len(m.Authority)+len(m.Additional); g != e {
+		t.Fatal(50, g, e)
+	}
+
+	q := recs[0]
+	if g, e := q.Section, SectionQuestion; g != e {
+		t.Fatal(60, g, e)
+	}
+
+	if g, e := q.QuestionItem().String(), m.Question[0].String(); g != e {
+		t.Fatal(70, g, e)
+	}
+
+	if !q.Name.Equal("WWW.Example.com") || !q.Name.Equal("www.example.com.") || q.Name.Equal("www.example.co") || q.Name.Equal("ww.example.com") || q.Name.Equal(".") {
+		t.Fatal(80, q.Name)
+	}
+
+	if _, err := q.RR(); err == nil {
+		t.Fatal(90)
+	}
+
+	sections := []Section{SectionAnswer, SectionAnswer, SectionAuthority, SectionAuthority, SectionAuthority, SectionAuthority, SectionAdditional, SectionAdditional}
+	for i, rec := range append(append(append(rr.RRs(nil), m.Answer...), m.Authority...), m.Additional...) {
+		r := recs[i+1]
+		if g, e := r.Section, sections[i]; g != e {
+			t.Fatal(100, i, g, e)
+		}
+
+		if g, e := r.Name.String(), rec.Name; g != e {
+			t.Fatal(110, i, g, e)
+		}
+
+		if r.Type != rec.Type || r.Class != rec.Class || r.TTL != rec.TTL {
+			t.Fatal(120, i, r.Type, r.Class, r.TTL, rec)
+		}
+
+		if i+2 < len(recs) {
+			if g, e := r.RDataOffset+len(r.RData), recs[i+2].off; g != e {
+				t.Fatal(130, i, g, e)
+			}
+		}
+
+		x, err := r.RR()
+		if err != nil {
+			t.Fatal(140, i, err)
+		}
+
+		if g, e := x.String(), rec.String(); g != e {
+			t.Fatal(150, i, g, e)
+		}
+	}
+
+	cname := recs[1]
+	n, end, err := ps.Name(cname.RDataOffset)
+	if err != nil {
+		t.Fatal(160, err)
+	}
+
+	if !n.Equal("example.com") || end != cname.RDataOffset+len(cname.RData) {
+		t.Fatal(170, n, end)
+	}
+
+	root := recs[len(recs)-1].Name
+	if g, e := root.String(), "."; g != e || !root.Equal(".") || !root.Equal("") {
+		t.Fatal(180, g, e)
+	}
+
+	trailing := append(append([]byte(nil), b...), 0)
+	if err := ps.Start(trailing); err != nil {
+		t.Fatal(190, err)
+	}
+
+	for {
+		if _, err = ps.Next(); err != nil {
+			break
+		}
+	}
+	if e, ok := err.(*dns.DecodeError); !ok || !errors.Is(err, dns.ErrTrailing) || e.Offset != len(b) {
+		t.Fatal(200, err)
+	}
+
+	count := append([]byte(nil), b...)
+	count[7] = 0xff
+	if err := ps.Start(count); !errors.Is(err, dns.ErrCount) {
+		t.Fatal(210, err)
+	}
+}
+
+func TestParserAllocs(t *testing.T) {
+	b := sample()
+	buf := make([]byte, 0, dns.MaxNameLen)
+	var ps Parser
+	n := testing.AllocsPerRun(100, func() {
+		if err := ps.Start(b); err != nil {
+			t.Fatal(10, err)
+		}
+
+		for {
+			r, err := ps.Next()
+			if err == io.EOF {
+				break
+			}
+
+			if err != nil {
+				t.Fatal(20, err)
+			}
+
+			r.Name.Equal("example.com")
+			buf = r.Name.AppendText(buf[:0])
+			if r.Type == rr.TYPE_CNAME {
+				if _, _, err = ps.Name(r.RDataOffset); err != nil {
+					t.Fatal(30, err)
+				}
+			}
+		}
+	})
+	if n != 0 {
+		t.Fatal(40, n)
+	}
+}
+
+func TestParserRData(t *testing.T) {
+	// An answer A record with 3 bytes of RDATA.
+	b := []byte{
+		0, 0, 0x80, 0, 0, 0, 0, 1, 0, 0, 0, 0,
+		0, 0, 1, 0, 1, 0, 0, 0, 0, 0, 3, 192, 0, 2,
+	}
+	var ps Parser
+	if err := ps.Start(b); err != nil {
+		t.Fatal(10, err)
+	}
+
+	r, err := ps.Next()
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	if _, err = ps.Next(); err != io.EOF {
+		t.Fatal(30, err)
+	}
+
+	if _, err = r.RR(); err == nil {
+		t.Fatal(40)
+	}
+
+	m := &Message{}
+	p := 0
+	if err = m.Decode(b, &p, nil); err == nil {
+		t.Fatal(50, m)
+	}
+}
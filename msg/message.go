@@ -8,6 +8,7 @@
 package msg
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/cznic/dns"
@@ -225,25 +226,25 @@ func (m *Header) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err
 	w >>= 4
 	m.QR = w&1 != 0
 
-	if w.Decode(b, pos, sniffer); err != nil {
+	if err = w.Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
 	m.QDCOUNT = uint16(w)
 
-	if w.Decode(b, pos, sniffer); err != nil {
+	if err = w.Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
 	m.ANCOUNT = uint16(w)
 
-	if w.Decode(b, pos, sniffer); err != nil {
+	if err = w.Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
 	m.NSCOUNT = uint16(w)
 
-	if w.Decode(b, pos, sniffer); err != nil {
+	if err = w.Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
@@ -294,43 +295,71 @@ func (m *Message) Encode(b *dns.Wirebuf) {
 	}
 }
 
-// Implementation of dns.Wirer
+// Minimal wire lengths of a question item and of a RR, i.e. with the root
+// name and no RDATA.
+const (
+	minQuestionLen = 1 + 2 + 2
+	minRRLen       = 1 + 2 + 2 + 4 + 2
+)
+
+// decodeError returns err as a *dns.DecodeError of section. ofs is the
+// offset reported for errors not telling their own.
+func decodeError(err error, section string, ofs int) error {
+	if e, ok := err.(*dns.DecodeError); ok {
+		if e.Section == "" {
+			e.Section = section
+		}
+		return e
+	}
+
+	return &dns.DecodeError{Section: section, Offset: ofs, Err: err}
+}
+
+// Implementation of dns.Wirer. Errors of malformed wire data are
+// *dns.DecodeErrors. Decoding domain names is limited by dns.MaxLabelLen,
+// dns.MaxNameLen and dns.MaxPointers, the record counts of the header must be
+// consistent with the length of b and the message must end at the end of b.
 func (m *Message) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
 	var p0 *byte
 	if p0, err = bufp0(b, pos); err != nil {
-		return
+		return decodeError(err, "header", *pos)
 	}
+	ofs := *pos
 	if err = m.Header.Decode(b, pos, sniffer); err != nil {
-		return
+		return decodeError(err, "header", ofs)
+	}
+
+	if int(m.QDCOUNT)*minQuestionLen+(int(m.ANCOUNT)+int(m.NSCOUNT)+int(m.ARCOUNT))*minRRLen > len(b)-*pos {
+		return &dns.DecodeError{Section: "header", Offset: ofs, Err: dns.ErrCount}
 	}
 
 	m.Question = make([]*QuestionItem, m.QDCOUNT)
 	if m.QDCOUNT != 0 {
 		if err = m.Question.Decode(b, pos, sniffer); err != nil {
-			return
+			return decodeError(err, "question", *pos)
 		}
 	}
 
 	if m.ANCOUNT != 0 {
 		if err = decodeRRs(&m.Answer, m.ANCOUNT, b, pos, sniffer); err != nil {
-			return
+			return decodeError(err, "answer", *pos)
 		}
 	}
 
 	if m.NSCOUNT != 0 {
 		if err = decodeRRs(&m.Authority, m.NSCOUNT, b, pos, sniffer); err != nil {
-			return
+			return decodeError(err, "authority", *pos)
 		}
 	}
 
 	if m.ARCOUNT != 0 {
 		if err = decodeRRs(&m.Additional, m.ARCOUNT, b, pos, sniffer); err != nil {
-			return
+			return decodeError(err, "additional", *pos)
 		}
 	}
 
 	if *pos != len(b) {
-		return fmt.Errorf("Message.Decode() - %d extra bytes", *pos-len(b))
+		return &dns.DecodeError{Offset: *pos, Err: dns.ErrTrailing}
 	}
 
 	if sniffer != nil {
@@ -380,20 +409,30 @@ func (m *Message) additionalString() string {
 	return strings.Join(a, "\n")
 }
 
+// IsStream returns whether conn is a stream connection, i.e. a *net.TCPConn or
+// a *tls.Conn, over which DNS messages are prefixed by their 2 byte length
+// (rfc1035/4.2.2, rfc7858/3.3).
+func IsStream(conn net.Conn) bool {
+	switch conn.(type) {
+	case *net.TCPConn, *tls.Conn:
+		return true
+	}
+
+	return false
+}
+
 // SendWire sends w through conn and returns an Error of any.  If the conn is a
-// *net.TCPConn then the 2 byte msg len is prepended.
+// stream connection (see IsStream) then the 2 byte msg len is prepended and
+// the message is written at once.
 func SendWire(conn net.Conn, w []byte) (err error) {
 	var nw int
-	if _, ok := conn.(*net.TCPConn); ok {
+	if IsStream(conn) {
 		n := len(w)
-		b := []byte{byte(n >> 8), byte(n)}
-		if nw, err = conn.Write(b); err != nil {
-			return
+		if n > math.MaxUint16 {
+			return fmt.Errorf("Message.Send: message too long: %d", n)
 		}
 
-		if nw != len(b) {
-			return fmt.Errorf("Message.Send: write %d != %d", nw, len(b))
-		}
+		w = append([]byte{byte(n >> 8), byte(n)}, w...)
 	}
 
 	if nw, err = conn.Write(w); err != nil {
@@ -407,7 +446,7 @@ func SendWire(conn net.Conn, w []byte) (err error) {
 }
 
 // Send sends m through conn and returns an Error of any.
-// If the conn is a *net.TCPConn then the 2 byte msg len is prepended.
+// If the conn is a stream connection then the 2 byte msg len is prepended.
 func (m *Message) Send(conn net.Conn) (err error) {
 	w := dns.NewWirebuf()
 	m.Encode(w)
@@ -415,21 +454,26 @@ func (m *Message) Send(conn net.Conn) (err error) {
 }
 
 // ReceiveWire reads a DNS packet from conn, copying the payload into rxbuf.
-// It returns the number of bytes copied into rxbuf.  If conn is a net.TCPConn
-// then a 2 byte msg len prefix is expected firstly and those two prefix bytes
-// are not reflected in the returned size n. If conn is a net.UPConn then the
-// originating address is returned in addr, otherwise addr will be nil.
-// ReceiveWire can hang forever if the conn doesn't have appropriate read
-// timeout already set.
+// It returns the number of bytes copied into rxbuf.  If conn is a stream
+// connection (see IsStream) then a 2 byte msg len prefix is expected firstly
+// and those two prefix bytes are not reflected in the returned size n. If
+// conn is a net.UPConn then the originating address is returned in addr,
+// otherwise addr will be nil. ReceiveWire can hang forever if the conn
+// doesn't have appropriate read timeout already set.
 func ReceiveWire(conn net.Conn, rxbuf []byte) (n int, addr *net.UDPAddr, err error) {
 	switch x := conn.(type) {
-	case *net.TCPConn:
+	case *net.TCPConn, *tls.Conn:
 		var b [2]byte
 		if n, err = io.ReadFull(conn, b[:]); err != nil {
 			return
 		}
 
 		n = int(b[0])<<8 | int(b[1])
+		if n > len(rxbuf) {
+			err = fmt.Errorf("ReceiveWire: message size %d exceeds rxbuf size %d", n, len(rxbuf))
+			return
+		}
+
 		nr := 0
 		if nr, err = io.ReadFull(conn, rxbuf[:n]); err != nil {
 			err = fmt.Errorf("msg.ReceiveBuf size=%d(got %d): %s", n, nr, err)
@@ -482,16 +526,24 @@ func (m *Message) ReceiveUDP(conn *net.UDPConn, rxbuf []byte) (n int, addr *net.
 
 // ExchangeWire exchanges a msg 'w' already in wire format through conn and
 // returns a reply or an Error if any.  ExchangeBuf uses rxbuf for receiving
-// the reply. ExchangeWire can hang forever if the conn doesn't have
-// appropriate read and/or write timeouts already set.  Returned n reflects the
-// number of bytes revecied to rxbuf.
+// the reply. If the conn is a stream connection then the 2 byte msg len is
+// prepended to w and expected in front of the reply. ExchangeWire can hang
+// forever if the conn doesn't have appropriate read and/or write timeouts
+// already set.  Returned n reflects the number of bytes revecied to rxbuf.
 func ExchangeWire(conn net.Conn, w, rxbuf []byte) (n int, reply *Message, err error) {
 	if err = SendWire(conn, w); err != nil {
 		return
 	}
 
-	if n, err = conn.Read(rxbuf); err != nil {
-		return
+	switch conn.(type) {
+	case *net.TCPConn, *tls.Conn:
+		if n, _, err = ReceiveWire(conn, rxbuf); err != nil {
+			return
+		}
+	default:
+		if n, err = conn.Read(rxbuf); err != nil {
+			return
+		}
 	}
 
 	reply = &Message{}
@@ -917,7 +969,13 @@ const (
 	//                 a particular operation (e.g., zone
 	//                 transfer) for particular data.
 	RC_REFUSED
-	// 6-15            Reserved for future use.
+	// 6               YXDOMAIN - Some name that ought not to
+	//                 exist, does exist (rfc2136/2.2). Also
+	//                 returned when a DNAME substitution would
+	//                 produce a name exceeding the legal
+	//                 length (rfc6672/2.2).
+	RC_YXDOMAIN
+	// 7-15            Reserved for future use.
 	_
 )
 
@@ -935,6 +993,8 @@ func (r RCODE) String() string {
 		return "RC_NOT_IMPLEMENETD"
 	case RC_REFUSED:
 		return "RC_REFUSED"
+	case RC_YXDOMAIN:
+		return "RC_YXDOMAIN"
 	}
 	return fmt.Sprintf("%d!", r)
 }
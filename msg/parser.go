@@ -0,0 +1,271 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package msg
+
+import (
+	"errors"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/rr"
+	"io"
+)
+
+// Section is a section of a DNS message.
+type Section int
+
+// Values of Section.
+const (
+	SectionQuestion Section = iota
+	SectionAnswer
+	SectionAuthority
+	SectionAdditional
+)
+
+var sectionStr = [...]string{
+	SectionQuestion:   "question",
+	SectionAnswer:     "answer",
+	SectionAuthority:  "authority",
+	SectionAdditional: "additional",
+}
+
+func (s Section) String() string {
+	if s >= 0 && int(s) < len(sectionStr) {
+		return sectionStr[s]
+	}
+
+	return "section?"
+}
+
+// Name is a domain name in the wire format of a DNS message. It refers to the
+// message and is decoded on demand. Only String allocates.
+type Name struct {
+	msg []byte
+	off int
+}
+
+// Offset returns the offset of n in its message.
+func (n Name) Offset() int {
+	return n.off
+}
+
+// Labels calls f with every label of n, except the root one. The label is a
+// slice of the message.
+func (n Name) Labels(f func(label []byte)) {
+	dns.WalkName(n.msg, n.off, f)
+}
+
+// AppendText appends the text form of n, e.g. "www.example.com.", to dst
+// and returns the extended buffer.
+func (n Name) AppendText(dst []byte) []byte {
+	i := len(dst)
+	n.Labels(func(label []byte) {
+		dst = append(dst, label...)
+		dst = append(dst, '.')
+	})
+	if len(dst) == i {
+		dst = append(dst, '.')
+	}
+	return dst
+}
+
+// String returns the text form of n.
+func (n Name) String() string {
+	return string(n.AppendText(make([]byte, 0, dns.MaxNameLen)))
+}
+
+// Equal reports whether n is name, compared case-insensitively. name is in
+// the text form, the trailing dot is optional.
+func (n Name) Equal(name string) bool {
+	if name == "." {
+		name = ""
+	}
+	ok := true
+	n.Labels(func(label []byte) {
+		switch {
+		case !ok:
+		case len(name) < len(label) || !equalFold(label, name[:len(label)]):
+			ok = false
+		case len(label) == len(name):
+			name = ""
+		case name[len(label)] != '.':
+			ok = false
+		default:
+			name = name[len(label)+1:]
+		}
+	})
+	return ok && name == ""
+}
+
+// equalFold reports whether a and b are equal, ignoring the case of ASCII
+// letters.
+func equalFold(a []byte, b string) bool {
+	for i, c := range a {
+		d := b[i]
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if 'A' <= d && d <= 'Z' {
+			d += 'a' - 'A'
+		}
+		if c != d {
+			return false
+		}
+	}
+	return true
+}
+
+// Record is an item of a section of a DNS message as seen by a Parser. Its
+// Name and RData refer to the message.
+type Record struct {
+	Section Section
+	Name    Name
+	Type    rr.Type  // The QTYPE in the question section.
+	Class   rr.Class // The QCLASS in the question section.
+	TTL     int32    // Zero in the question section.
+	RData   []byte   // The RDATA, a slice of the message, nil in the question section.
+	// RDataOffset is the offset of RData in the message, see
+	// Parser.Name.
+	RDataOffset int
+
+	msg []byte
+	off int
+}
+
+// RR decodes r into an *rr.RR. An error is returned for records of the
+// question section, see QuestionItem.
+func (r *Record) RR() (y *rr.RR, err error) {
+	if r.Section == SectionQuestion {
+		return nil, &dns.DecodeError{Section: r.Section.String(), Offset: r.off, Err: errQuestionRR}
+	}
+
+	y = &rr.RR{}
+	p := r.off
+	if err = y.Decode(r.msg, &p, nil); err != nil {
+		return nil, decodeError(err, r.Section.String(), r.off)
+	}
+
+	return
+}
+
+// QuestionItem returns the question item of r. It is meaningful only for
+// records of the question section.
+func (r *Record) QuestionItem() *QuestionItem {
+	return &QuestionItem{r.Name.String(), QType(r.Type), r.Class}
+}
+
+var errQuestionRR = errors.New("msg: a question is not a RR")
+
+// Parser iterates over the records of a DNS message in wire format without
+// decoding it into a Message. Parsing allocates nothing, names and RDATA are
+// exposed by values referring to the message. A Parser checks only the
+// header counts, the names of the records and that every record, including
+// its RDLENGTH, fits the message. The RDATA is not checked until Record.RR
+// decodes it, so a message Message.Decode rejects may still parse. Errors of
+// malformed data are *dns.DecodeErrors.
+//
+// A Parser is used like
+//
+//	var p msg.Parser
+//	if err := p.Start(b); err != nil {
+//		...
+//	}
+//
+//	for {
+//		r, err := p.Next()
+//		if err == io.EOF {
+//			break
+//		}
+//
+//		if err != nil {
+//			...
+//		}
+//
+//		... r.Section, r.Name, r.Type, r.RData ...
+//	}
+type Parser struct {
+	Header // The header of the message, valid after Start.
+
+	msg     []byte
+	off     int
+	section Section
+	left    [4]int // records left in the sections
+}
+
+// Start makes p parse the message b, decoding its header. The record counts
+// of the header must be consistent with the length of b.
+func (p *Parser) Start(b []byte) (err error) {
+	*p = Parser{msg: b}
+	if err = p.Header.Decode(b, &p.off, nil); err != nil {
+		return decodeError(err, "header", 0)
+	}
+
+	if int(p.QDCOUNT)*minQuestionLen+(int(p.ANCOUNT)+int(p.NSCOUNT)+int(p.ARCOUNT))*minRRLen > len(b)-p.off {
+		return &dns.DecodeError{Section: "header", Offset: 0, Err: dns.ErrCount}
+	}
+
+	p.left = [4]int{int(p.QDCOUNT), int(p.ANCOUNT), int(p.NSCOUNT), int(p.ARCOUNT)}
+	return
+}
+
+// Next returns the next record of the message. After the last one, Next
+// checks the message ends there and returns io.EOF.
+func (p *Parser) Next() (r Record, err error) {
+	for p.left[p.section] == 0 {
+		if p.section == SectionAdditional {
+			if p.off != len(p.msg) {
+				return r, &dns.DecodeError{Offset: p.off, Err: dns.ErrTrailing}
+			}
+
+			return r, io.EOF
+		}
+
+		p.section++
+	}
+
+	section := p.section.String()
+	r = Record{Section: p.section, msg: p.msg, off: p.off}
+	off, err := dns.WalkName(p.msg, p.off, nil)
+	if err != nil {
+		return Record{}, decodeError(err, section, p.off)
+	}
+
+	r.Name = Name{p.msg, p.off}
+	n := 4
+	if p.section != SectionQuestion {
+		n = 10
+	}
+	if off+n > len(p.msg) {
+		return Record{}, &dns.DecodeError{Section: section, Offset: off, Err: dns.ErrUnderflow}
+	}
+
+	b := p.msg[off:]
+	r.Type = rr.Type(b[0])<<8 | rr.Type(b[1])
+	r.Class = rr.Class(b[2])<<8 | rr.Class(b[3])
+	off += n
+	if p.section != SectionQuestion {
+		r.TTL = int32(b[4])<<24 | int32(b[5])<<16 | int32(b[6])<<8 | int32(b[7])
+		rdlength := int(b[8])<<8 | int(b[9])
+		if off+rdlength > len(p.msg) {
+			return Record{}, &dns.DecodeError{Section: section, Offset: off - 2, Err: dns.ErrRDLength}
+		}
+
+		r.RData, r.RDataOffset = p.msg[off:off+rdlength:off+rdlength], off
+		off += rdlength
+	}
+	p.off = off
+	p.left[p.section]--
+	return
+}
+
+// Name returns the domain name at off in the message, e.g. at the
+// RDataOffset of a CNAME record, and the offset of the byte following it.
+func (p *Parser) Name(off int) (n Name, end int, err error) {
+	if end, err = dns.WalkName(p.msg, off, nil); err != nil {
+		return
+	}
+
+	return Name{p.msg, off}, end, nil
+}
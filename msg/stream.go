@@ -0,0 +1,251 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package msg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/cznic/dns"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrStreamClosed is returned by StreamConn.Exchange when the connection was
+// closed by Close.
+var ErrStreamClosed = errors.New("msg: stream connection closed")
+
+// StreamConn pipelines DNS message exchanges over a stream connection, e.g.
+// a *net.TCPConn or a *tls.Conn (rfc7766/6.2.1.1, rfc7858/3.3). Queries are
+// sent without waiting for the replies to the previous ones and replies are
+// matched to queries by their IDs, in whatever order they arrive. StreamConn
+// is safe for concurrent use.
+type StreamConn struct {
+	conn    net.Conn
+	done    chan struct{} // closed when the connection fails or is closed
+	err     error
+	pending map[uint16]chan *Message
+	lock    sync.Mutex // guards err and pending
+	wlock   sync.Mutex // serializes writes
+}
+
+// NewStreamConn returns a StreamConn using conn. conn must not be used by the
+// caller afterwards, except for its Close, which is equivalent to the Close
+// of the StreamConn.
+func NewStreamConn(conn net.Conn) (c *StreamConn) {
+	c = &StreamConn{conn: conn, done: make(chan struct{}), pending: map[uint16]chan *Message{}}
+	go c.read()
+	return
+}
+
+// read receives replies and dispatches them to the waiting Exchanges until
+// the connection fails.
+func (c *StreamConn) read() {
+	rxbuf := make([]byte, math.MaxUint16)
+	for {
+		n, _, err := ReceiveWire(c.conn, rxbuf)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		reply := &Message{}
+		p := 0
+		if err = reply.Decode(rxbuf[:n], &p, nil); err != nil {
+			c.fail(err)
+			return
+		}
+
+		c.lock.Lock() // X++
+		ch, ok := c.pending[reply.ID]
+		delete(c.pending, reply.ID)
+		c.lock.Unlock() // X--
+		if ok {
+			ch <- reply
+		}
+	}
+}
+
+// fail closes c with err, unless it is already closed.
+func (c *StreamConn) fail(err error) {
+	c.lock.Lock()         // X++
+	defer c.lock.Unlock() // X--
+
+	if c.err != nil {
+		return
+	}
+
+	c.err = err
+	c.conn.Close()
+	close(c.done)
+}
+
+// Err returns the error which closed c or nil if c is still usable.
+func (c *StreamConn) Err() error {
+	c.lock.Lock()         // X++
+	defer c.lock.Unlock() // X--
+
+	return c.err
+}
+
+// Pending returns the number of exchanges waiting for a reply.
+func (c *StreamConn) Pending() int {
+	c.lock.Lock()         // X++
+	defer c.lock.Unlock() // X--
+
+	return len(c.pending)
+}
+
+// Close closes c. Exchanges in progress fail with ErrStreamClosed.
+func (c *StreamConn) Close() error {
+	c.fail(ErrStreamClosed)
+	return nil
+}
+
+// Exchange sends m and waits for its reply, bounded by ctx. If the ID of m
+// is already used by another exchange in progress, the query is sent with a
+// free one instead, m itself is never modified. The ID of the reply is set
+// to m.ID. The reply is matched to the query by its ID only, checking it
+// answers the question of m is up to the caller.
+func (c *StreamConn) Exchange(ctx context.Context, m *Message) (reply *Message, err error) {
+	ch := make(chan *Message, 1)
+	id := m.ID
+	c.lock.Lock() // X++
+	if err = c.err; err != nil {
+		c.lock.Unlock() // X--
+		return
+	}
+
+	for i := 0; ; i++ {
+		if _, ok := c.pending[id]; !ok {
+			break
+		}
+
+		if i == math.MaxUint16 {
+			c.lock.Unlock() // X--
+			return nil, fmt.Errorf("StreamConn.Exchange: no free message ID")
+		}
+
+		id = GenID()
+	}
+	c.pending[id] = ch
+	c.lock.Unlock() // X--
+
+	defer func() {
+		if err != nil {
+			c.lock.Lock() // X++
+			delete(c.pending, id)
+			c.lock.Unlock() // X--
+		}
+	}()
+
+	q := *m
+	q.ID = id
+	w := dns.NewWirebuf()
+	q.Encode(w)
+	if err = c.write(ctx, w.Buf); err != nil {
+		return
+	}
+
+	select {
+	case reply = <-ch:
+		reply.ID = m.ID
+		return
+	case <-c.done:
+		return nil, c.Err()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// write sends w through c, the write is bounded by ctx. A failed write
+// closes c as the stream may be left in the middle of a message.
+func (c *StreamConn) write(ctx context.Context, w []byte) (err error) {
+	c.wlock.Lock()         // W++
+	defer c.wlock.Unlock() // W--
+
+	if d, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(d)
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	if err = SendWire(c.conn, w); err != nil {
+		c.fail(err)
+	}
+	return
+}
+
+// Responder answers DNS queries received by a server.
+type Responder interface {
+	// Respond returns the reply to query received from remote or nil if
+	// no reply should be sent.
+	Respond(query *Message, remote net.Addr) (reply *Message)
+}
+
+// ResponderFunc is an adapter to use an ordinary function as a Responder.
+type ResponderFunc func(query *Message, remote net.Addr) (reply *Message)
+
+// Respond implements Responder.
+func (f ResponderFunc) Respond(query *Message, remote net.Addr) (reply *Message) {
+	return f(query, remote)
+}
+
+// ServeStream reads queries from the stream connection conn and writes the
+// replies of r back to it. Queries are answered concurrently, replies are
+// written as they become available, i.e. possibly out of order
+// (rfc7766/6.2.1.1). If idle is not zero, the connection is closed after no
+// query arrives for idle. ServeStream returns when the connection is closed by
+// the peer (with a nil error), fails, or a query cannot be decoded, after all
+// replies in progress are written. ServeStream closes conn before returning.
+func ServeStream(conn net.Conn, r Responder, idle time.Duration) (err error) {
+	var wg sync.WaitGroup
+	var wlock sync.Mutex
+	defer func() {
+		wg.Wait()
+		conn.Close()
+	}()
+
+	rxbuf := make([]byte, math.MaxUint16)
+	for {
+		if idle != 0 {
+			conn.SetReadDeadline(time.Now().Add(idle))
+		}
+		var n int
+		if n, _, err = ReceiveWire(conn, rxbuf); err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			if e, ok := err.(net.Error); ok && e.Timeout() {
+				err = nil
+			}
+			return
+		}
+
+		query := &Message{}
+		p := 0
+		if err = query.Decode(rxbuf[:n], &p, nil); err != nil {
+			return
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reply := r.Respond(query, conn.RemoteAddr())
+			if reply == nil {
+				return
+			}
+
+			wlock.Lock()         // W++
+			defer wlock.Unlock() // W--
+
+			reply.Send(conn)
+		}()
+	}
+}
@@ -7,7 +7,26 @@
 package resolver
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/cache"
+	"github.com/cznic/dns/doh"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/named"
+	"github.com/cznic/dns/resolv"
+	"github.com/cznic/dns/rr"
+	"github.com/cznic/dns/transport"
+	"log"
+	"math"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestNilLoggerBug(t *testing.T) {
@@ -19,3 +38,1435 @@ func TestNilLoggerBug(t *testing.T) {
 
 	New("", "", nil)
 }
+
+func TestLookupContext(t *testing.T) {
+	r, err := New("", "", nil)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, result, err := r.LookupContext(ctx, "example.com.", msg.QTYPE_A, rr.CLASS_IN, false)
+	if err != context.Canceled || result != LookupFail {
+		t.Fatal(10, result, err)
+	}
+
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	if _, _, err = r.GetHostByNameContext(ctx, "example.com.", false); err != context.DeadlineExceeded {
+		t.Fatal(20, err)
+	}
+}
+
+func TestFlights(t *testing.T) {
+	f := newFlights()
+	var calls int32
+	start := make(chan bool)
+	fn := func(context.Context) (interface{}, error) {
+		atomic.AddInt32(&calls, 1)
+		<-start
+		return 42, nil
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	var nshared int32
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err, shared := f.do(context.Background(), "k", 0, fn)
+			if err != nil || v != 42 {
+				t.Error(10, v, err)
+			}
+			if shared {
+				atomic.AddInt32(&nshared, 1)
+			}
+		}()
+	}
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(start)
+	wg.Wait()
+	if calls != 1 || nshared != n-1 {
+		t.Fatal(20, calls, nshared)
+	}
+
+	if _, _, shared := f.do(context.Background(), "k", time.Hour, func(context.Context) (interface{}, error) { return 1, nil }); shared {
+		t.Fatal(30)
+	}
+
+	if v, _, shared := f.do(context.Background(), "k", 0, fn); !shared || v != 1 {
+		t.Fatal(40, v, shared)
+	}
+
+	if _, _, shared := f.do(context.Background(), "e", time.Hour, func(context.Context) (interface{}, error) { return nil, context.Canceled }); shared {
+		t.Fatal(50)
+	}
+
+	if _, ok := f.m["e"]; ok {
+		t.Fatal(60, "failed invocation held")
+	}
+}
+
+func TestFlightsCancel(t *testing.T) {
+	called, release := make(chan bool), make(chan bool)
+	mem := transport.MemNet{"192.0.2.1": msg.ResponderFunc(func(query *msg.Message, remote net.Addr) *msg.Message {
+		called <- true
+		<-release
+		query.QR = true
+		query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 80)}}}
+		return query
+	})}
+	r := &Resolver{log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+	r.SetTransport(mem.Factory)
+	ip := net.IPv4(192, 0, 2, 1)
+	m := newQuery("example.com.", msg.QTYPE_A, rr.CLASS_IN, true, false)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := r.query(ctx, "udp", m, ip, time.Minute, true)
+		leader <- err
+	}()
+	<-called
+
+	type result struct {
+		reply *msg.Message
+		err   error
+	}
+	follower := make(chan result)
+	go func() {
+		reply, err := r.query(context.Background(), "udp", m, ip, time.Minute, true)
+		follower <- result{reply, err}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-leader; err != context.Canceled {
+		t.Fatal(10, err)
+	}
+
+	close(release)
+	if x := <-follower; x.err != nil || len(x.reply.Answer) != 1 {
+		t.Fatal(20, x.reply, x.err)
+	}
+
+	f := newFlights()
+	started, aborted := make(chan bool), make(chan bool)
+	fn := func(ctx context.Context) (interface{}, error) {
+		started <- true
+		<-ctx.Done()
+		aborted <- true
+		return nil, ctx.Err()
+	}
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	errs := make(chan error, 2)
+	go func() { _, err, _ := f.do(ctx1, "k", 0, fn); errs <- err }()
+	<-started
+	go func() { _, err, _ := f.do(ctx2, "k", 0, fn); errs <- err }()
+	for {
+		f.lock.Lock()
+		n := f.m["k"].waiters
+		f.lock.Unlock()
+		if n == 2 {
+			break
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+	cancel1()
+	if err := <-errs; err != context.Canceled {
+		t.Fatal(30, err)
+	}
+
+	select {
+	case <-aborted:
+		t.Fatal(40, "aborted while shared")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	cancel2()
+	if err := <-errs; err != context.Canceled {
+		t.Fatal(50, err)
+	}
+
+	<-aborted
+	f.lock.Lock()
+	_, ok := f.m["k"]
+	f.lock.Unlock()
+	if ok {
+		t.Fatal(60, "abandoned flight kept")
+	}
+
+	x := exchangeFunc(func(ctx context.Context, m *msg.Message) (*msg.Message, error) {
+		started <- true
+		<-ctx.Done()
+		defer func() { aborted <- true }()
+		return nil, ctx.Err()
+	})
+	r.SetTransport(func(string, net.IP) (transport.Exchanger, error) { return x, nil })
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() { _, err := r.query(ctx, "udp", m, ip, time.Minute, true); errs <- err }()
+	<-started
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Fatal(70, err)
+	}
+
+	<-aborted
+	time.Sleep(10 * time.Millisecond) // let query record the outcome, if any
+	if st := r.ServerStats()[ip.String()]; st.Failures != 0 {
+		t.Fatal(80, &st)
+	}
+}
+
+func TestSharedReply(t *testing.T) {
+	release := make(chan bool)
+	x := exchangeFunc(func(ctx context.Context, m *msg.Message) (*msg.Message, error) {
+		<-release
+		reply := *m
+		reply.QR = true
+		reply.Answer = rr.RRs{&rr.RR{m.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 80)}}}
+		return &reply, nil
+	})
+	r := &Resolver{log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+	r.SetTransport(func(string, net.IP) (transport.Exchanger, error) { return x, nil })
+	ip := net.IPv4(192, 0, 2, 1)
+	m := newQuery("example.com.", msg.QTYPE_A, rr.CLASS_IN, true, false)
+	replies := make(chan *msg.Message, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			reply, err := r.query(context.Background(), "udp", m, ip, time.Minute, true)
+			if err != nil {
+				t.Error(10, err)
+			}
+			replies <- reply
+		}()
+	}
+	for n := 0; n != 2; time.Sleep(time.Millisecond) {
+		r.flights.lock.Lock()
+		for _, c := range r.flights.m {
+			n = c.waiters
+		}
+		r.flights.lock.Unlock()
+	}
+	close(release)
+	a, b := <-replies, <-replies
+	if a == nil || b == nil || len(a.Answer) != 1 || len(b.Answer) != 1 {
+		t.Fatal(20, a, b)
+	}
+
+	a.Answer[0].TTL, a.Answer[0].RData.(*rr.A).Address[15] = 1, 81
+	if g := b.Answer[0].String(); g != "example.com.\tIN\t60\tA 192.0.2.80" {
+		t.Fatal(30, g)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	s := newServerStats()
+	fast, slow, dead := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)
+	s.rtt(fast, 10*time.Millisecond)
+	s.rtt(slow, 100*time.Millisecond)
+	for i := 0; i < backoffAfter; i++ {
+		s.fail(dead, time.Second)
+	}
+
+	probes := 0
+	for i := 0; i < 1000; i++ {
+		ips, best := s.order([]net.IP{dead, slow, fast})
+		if len(ips) != 2 {
+			t.Fatal(10, ips)
+		}
+
+		switch {
+		case ips[0].Equal(fast):
+			if best != 10*time.Millisecond {
+				t.Fatal(20, best)
+			}
+		case ips[0].Equal(slow):
+			probes++
+		default:
+			t.Fatal(30, ips)
+		}
+	}
+	if probes == 0 || probes > 200 {
+		t.Fatal(40, probes)
+	}
+
+	if ips, best := s.order([]net.IP{dead}); len(ips) != 1 || best != math.MaxInt64 {
+		t.Fatal(50, ips, best)
+	}
+
+	r := &Resolver{stats: s}
+	m := r.ServerStats()
+	if x := m[dead.String()]; x.Failures != backoffAfter || x.SRTT != 4*time.Second || !x.BackoffUntil.After(time.Now()) {
+		t.Fatal(60, x.String())
+	}
+
+	s.rtt(dead, 20*time.Millisecond)
+	if ips, _ := s.order([]net.IP{dead}); len(ips) != 1 || r.ServerStats()[dead.String()].Consecutive != 0 {
+		t.Fatal(70, ips)
+	}
+}
+
+func TestEDNSStats(t *testing.T) {
+	s := newServerStats()
+	ip := net.IPv4(10, 0, 0, 1)
+	if size, probe := s.edns(ip); size != ednsBufSize || !probe {
+		t.Fatal(10, size, probe)
+	}
+
+	s.ednsSize(ip, 100)
+	if size, probe := s.edns(ip); size != ednsMinSize || probe || s.m[ip.String()].EDNS != ednsMinSize {
+		t.Fatal(20, size, probe)
+	}
+
+	s.ednsSize(ip, 8192)
+	if size, _ := s.edns(ip); size != ednsBufSize {
+		t.Fatal(25, size)
+	}
+
+	s.shrinkPayload(ip, ednsBufSize)
+	if size, _ := s.edns(ip); size != ednsSafeSize {
+		t.Fatal(26, size)
+	}
+
+	s.shrinkPayload(ip, ednsSafeSize)
+	if size, _ := s.edns(ip); size != ednsMinSize {
+		t.Fatal(27, size)
+	}
+
+	s.noEDNS(ip)
+	if size, _ := s.edns(ip); size != 0 {
+		t.Fatal(30, size)
+	}
+
+	s.m[ip.String()].NoEDNSUntil = time.Now().Add(-time.Second)
+	if size, probe := s.edns(ip); size != ednsMinSize || !probe {
+		t.Fatal(40, size, probe)
+	}
+}
+
+// exchangeFunc is a transport.Exchanger. The reply is passed through the
+// wire format, as by a real transport.
+type exchangeFunc func(ctx context.Context, m *msg.Message) (*msg.Message, error)
+
+func (f exchangeFunc) Exchange(ctx context.Context, m *msg.Message) (reply *msg.Message, err error) {
+	if reply, err = f(ctx, m); err != nil {
+		return
+	}
+
+	w := dns.NewWirebuf()
+	reply.Encode(w)
+	reply = &msg.Message{}
+	p := 0
+	if err = reply.Decode(w.Buf, &p, nil); err != nil {
+		reply = nil
+	}
+	return
+}
+
+func TestEDNSPayload(t *testing.T) {
+	var sizes []int
+	var mtu int // replies to queries advertising more than mtu are lost, if non zero
+	var dead bool
+	x := exchangeFunc(func(ctx context.Context, m *msg.Message) (*msg.Message, error) {
+		size := 0
+		if o := opt(m); o != nil {
+			size = int(o.Class)
+		}
+		sizes = append(sizes, size)
+		if dead || mtu != 0 && size > mtu {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+
+		reply := *m
+		reply.QR = true
+		reply.Answer = rr.RRs{&rr.RR{m.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 80)}}}
+		reply.Additional = rr.RRs{&rr.RR{".", rr.TYPE_OPT, rr.Class(1400), 0, &rr.OPT{}}}
+		return &reply, nil
+	})
+	r := &Resolver{log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+	r.SetTransport(func(string, net.IP) (transport.Exchanger, error) { return x, nil })
+	ip := net.IPv4(192, 0, 2, 1)
+	ask := func() error {
+		_, err := r.ask(context.Background(), "udp", "example.com.", msg.QTYPE_A, rr.CLASS_IN, false, ip, 10*time.Millisecond)
+		return err
+	}
+
+	if err := ask(); err != nil {
+		t.Fatal(10, err)
+	}
+
+	if err := ask(); err != nil {
+		t.Fatal(20, err)
+	}
+
+	mtu = 1300
+	if err := ask(); err == nil {
+		t.Fatal(30)
+	}
+
+	if err := ask(); err != nil {
+		t.Fatal(40, err)
+	}
+
+	if g, e := fmt.Sprint(sizes), fmt.Sprint([]int{ednsBufSize, 1400, 1400, ednsSafeSize}); g != e {
+		t.Fatal(50, g, e)
+	}
+
+	if st := r.ServerStats()[ip.String()]; st.Failures != 1 || st.PayloadSize != ednsSafeSize {
+		t.Fatal(60, &st)
+	}
+
+	dead, ip = true, net.IPv4(192, 0, 2, 2)
+	if err := ask(); err == nil {
+		t.Fatal(70)
+	}
+
+	if st := r.ServerStats()[ip.String()]; st.Failures != 1 || st.Queries != 1 {
+		t.Fatal(80, &st)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	var mode int
+	x := exchangeFunc(func(ctx context.Context, m *msg.Message) (*msg.Message, error) {
+		switch mode {
+		case 0: // a reply to another question
+			reply := *m
+			reply.QR = true
+			reply.Question = msg.Question{&msg.QuestionItem{"other.example.", msg.QTYPE_A, rr.CLASS_IN}}
+			return &reply, nil
+		case 1:
+			return nil, fmt.Errorf("connection refused")
+		default:
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+	})
+	r := &Resolver{log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+	r.SetTransport(func(string, net.IP) (transport.Exchanger, error) { return x, nil })
+	ip := net.IPv4(192, 0, 2, 1)
+	m := r.question("example.com.", msg.QTYPE_A, rr.CLASS_IN, false, 0, ip)
+	for i, test := range []struct {
+		mode                       int
+		charge                     bool
+		queries, failures, rejects int
+		srtt                       time.Duration
+	}{
+		{0, true, 1, 0, 1, 0},
+		{1, true, 2, 1, 1, 0},
+		{2, false, 2, 1, 1, 0},
+		{2, true, 3, 2, 1, 10 * time.Millisecond},
+	} {
+		mode = test.mode
+		if _, err := r.query(context.Background(), "udp", m, ip, 10*time.Millisecond, test.charge); err == nil {
+			t.Fatal(10, i)
+		}
+
+		st := r.ServerStats()[ip.String()]
+		if st.Queries != test.queries || st.Failures != test.failures || st.Rejected != test.rejects || st.SRTT != test.srtt {
+			t.Fatal(20, i, &st)
+		}
+	}
+}
+
+func TestSortIPs(t *testing.T) {
+	c := resolv.NewConf()
+	if err := c.LoadString("test", "sortlist 130.155.160.0/255.255.240.0 10.0.0.0\n"); err != nil {
+		t.Fatal(10, err)
+	}
+
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("10.1.2.3"),
+		net.ParseIP("130.155.161.1"),
+		net.ParseIP("130.155.100.1"),
+		net.ParseIP("10.3.2.1"),
+	}
+	sortIPs(c.Sortlist, ips)
+	var a []string
+	for _, ip := range ips {
+		a = append(a, ip.String())
+	}
+	if g, e := strings.Join(a, " "), "130.155.161.1 10.1.2.3 10.3.2.1 192.0.2.1 2001:db8::1 130.155.100.1"; g != e {
+		t.Fatalf("20\n%s\n%s", g, e)
+	}
+}
+
+func TestRotate(t *testing.T) {
+	c := resolv.NewConf()
+	if err := c.LoadString("test", "nameserver 192.0.2.1\nnameserver 192.0.2.2\nnameserver 192.0.2.3\n"); err != nil {
+		t.Fatal(10, err)
+	}
+
+	r := &Resolver{}
+	r.getQueryConf = func() *queryConf { return &queryConf{Conf: c, Resolver: r} }
+	first := func() string { return r.sbelt().servers[0].ips[0].String() }
+	for i := 0; i < 3; i++ {
+		if g := first(); g != "192.0.2.1" {
+			t.Fatal(20, i, g)
+		}
+	}
+
+	c.Opt.Rotate = true
+	for i := 0; i < 6; i++ {
+		if g, e := first(), c.Nameserver[i%3].String(); g != e {
+			t.Fatal(30, i, g, e)
+		}
+	}
+}
+
+func TestMinimisedLabels(t *testing.T) {
+	labels, err := dns.Labels("a.b.c.d.e.f.g.h.i.j.k.l.m.n.o.p.q.r.s.t.example.com.")
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	have, count := 3, 0 // example.com.
+	var names []string
+	for have < len(labels) {
+		have = minimisedLabels(have, len(labels), count)
+		names = append(names, minimisedName(labels, have))
+		count++
+	}
+	if count > maxMinimiseCount+1 {
+		t.Fatal(20, count, names)
+	}
+
+	if g, e := names[0], "t.example.com."; g != e {
+		t.Fatal(30, g, e)
+	}
+
+	if g, e := names[len(names)-1], "a.b.c.d.e.f.g.h.i.j.k.l.m.n.o.p.q.r.s.t.example.com."; g != e {
+		t.Fatal(40, g, e)
+	}
+
+	if g := minimisedLabels(1, 1, 0); g != 1 {
+		t.Fatal(50, g)
+	}
+}
+
+func TestIsReferral(t *testing.T) {
+	ns := func(owner string) *rr.RR {
+		return &rr.RR{owner, rr.TYPE_NS, rr.CLASS_IN, 3600, &rr.NS{"ns.example.net."}}
+	}
+	m := &msg.Message{}
+	m.Authority = rr.RRs{ns("example.com.")}
+	if !isReferral(m, "example.com.", rr.CLASS_IN, 2) {
+		t.Fatal(10)
+	}
+
+	if isReferral(m, "example.com.", rr.CLASS_IN, 3) {
+		t.Fatal(20) // not below the zone asked
+	}
+
+	if isReferral(m, "example.org.", rr.CLASS_IN, 1) {
+		t.Fatal(30) // out of zone
+	}
+
+	m.Authority = append(m.Authority, &rr.RR{"example.com.", rr.TYPE_SOA, rr.CLASS_IN, 3600, &rr.SOA{}})
+	if isReferral(m, "example.com.", rr.CLASS_IN, 2) {
+		t.Fatal(40) // NODATA
+	}
+}
+
+func TestSetQNameMinimisation(t *testing.T) {
+	r := &Resolver{}
+	if g := r.QNameMinimisation(); g != QNameMinOff {
+		t.Fatal(10, g)
+	}
+
+	r.SetQNameMinimisation(QNameMinStrict)
+	if g := r.QNameMinimisation(); g != QNameMinStrict {
+		t.Fatal(20, g)
+	}
+}
+
+func TestForwarding(t *testing.T) {
+	r := &Resolver{}
+	if r.forwardingFor("example.com.") != nil || len(r.Forwarding()) != 0 {
+		t.Fatal(10)
+	}
+
+	port := named.IPPort(5353)
+	c := &named.Conf{
+		Options: &named.Options{Forward: named.ForwardOnly, Forwarders: named.IPs{{IP: net.IPv4(192, 0, 2, 1)}}},
+		Zones: named.Zones{
+			{Name: "corp.example.", Forwarders: named.IPs{{IP: net.IPv4(10, 0, 0, 1)}}},
+			{Name: "internal.corp.example.", Forwarders: named.IPs{}},
+			{Name: "plain.example."},
+		},
+	}
+	rules, err := NamedForwarding(c)
+	if err != nil {
+		t.Fatal(20, err)
+	}
+
+	r.SetForwarding(append(rules, Forwarding{Domain: "Public.Corp.Example"})...)
+	if g := len(r.Forwarding()); g != 4 {
+		t.Fatal(30, g)
+	}
+
+	for i, test := range []struct {
+		name string
+		fwd  string
+	}{
+		{"example.com.", "192.0.2.1"},
+		{"corp.example.", "10.0.0.1"},
+		{"www.corp.example.", "10.0.0.1"},
+		{"www.public.corp.example.", ""},
+		{"www.internal.corp.example.", ""},
+		{"www.plain.example.", "192.0.2.1"},
+	} {
+		rule := r.forwardingFor(test.name)
+		switch {
+		case test.fwd == "" && rule != nil:
+			t.Fatal(40, i, rule)
+		case test.fwd != "" && (rule == nil || rule.Forwarders[0].String() != test.fwd):
+			t.Fatal(50, i, rule)
+		}
+	}
+
+	if r.forwardingFor("example.com.").Forward != named.ForwardOnly {
+		t.Fatal(60)
+	}
+
+	r.SetForwarding()
+	if r.forwardingFor("example.com.") != nil {
+		t.Fatal(70)
+	}
+
+	c.Zones[0].Forwarders[0].Port = &port
+	if _, err := NamedForwarding(c); err == nil {
+		t.Fatal(80)
+	}
+}
+
+func TestStubCandidates(t *testing.T) {
+	c := resolv.NewConf()
+	if err := c.LoadString("test", "search a.example b.example\noptions ndots:2\n"); err != nil {
+		t.Fatal(10, err)
+	}
+
+	s := NewStubConf(c, nil)
+	for i, test := range []struct {
+		name string
+		e    string
+	}{
+		{"www", "www.a.example. www.b.example. www."},
+		{"www.x", "www.x.a.example. www.x.b.example. www.x."},
+		{"www.x.y", "www.x.y. www.x.y.a.example. www.x.y.b.example."},
+		{"www.x.", "www.x."},
+	} {
+		list, err := s.Candidates(test.name)
+		if err != nil {
+			t.Fatal(20, i, err)
+		}
+
+		if g := strings.Join(list, " "); g != test.e {
+			t.Fatalf("30 %d\n%s\n%s", i, g, test.e)
+		}
+	}
+
+	c = resolv.NewConf()
+	if err := c.LoadString("test", "domain corp.example\n"); err != nil {
+		t.Fatal(40, err)
+	}
+
+	if list, _ := NewStubConf(c, nil).Candidates("www"); strings.Join(list, " ") != "www.corp.example. www." {
+		t.Fatal(50, list)
+	}
+}
+
+func TestStubResult(t *testing.T) {
+	cname := func(owner, target string) *rr.RR {
+		return &rr.RR{owner, rr.TYPE_CNAME, rr.CLASS_IN, 60, &rr.CNAME{target}}
+	}
+	a := &rr.RR{"c.example.", rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 1)}}
+	m := &msg.Message{}
+	m.Answer = rr.RRs{a, cname("b.example.", "C.example."), cname("a.example.", "b.example.")}
+	result, answer, redirects := stubResult(m, "a.example.", msg.QTYPE_A, rr.CLASS_IN)
+	if result != LookupAliased || len(answer) != 1 || answer[0] != a || len(redirects) != 2 {
+		t.Fatal(10, result, answer, redirects)
+	}
+
+	m.Answer = rr.RRs{cname("b.example.", "a.example."), cname("a.example.", "b.example.")}
+	if result, _, _ := stubResult(m, "a.example.", msg.QTYPE_A, rr.CLASS_IN); result != LookupAliasLoop {
+		t.Fatal(20, result)
+	}
+
+	m.Answer = rr.RRs{cname("a.example.", "b.example.")}
+	m.RCODE = msg.RC_NAME_ERROR
+	if result, _, _ := stubResult(m, "a.example.", msg.QTYPE_A, rr.CLASS_IN); result != LookupAliasError {
+		t.Fatal(30, result)
+	}
+
+	m.Answer = nil
+	m.RCODE = msg.RC_NO_ERROR
+	if result, _, _ := stubResult(m, "a.example.", msg.QTYPE_A, rr.CLASS_IN); result != LookupDataNotFound {
+		t.Fatal(40, result)
+	}
+}
+
+func TestSortSRV(t *testing.T) {
+	srv := func(prio, weight uint16, target string) *rr.SRV {
+		return &rr.SRV{Priority: prio, Weight: weight, Port: 80, Target: target}
+	}
+	hits := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		a := []*rr.SRV{srv(20, 0, "c."), srv(10, 90, "a."), srv(10, 10, "b."), srv(10, 0, "z.")}
+		sortSRV(a)
+		if a[3].Target != "c." {
+			t.Fatal(10, a)
+		}
+
+		hits[a[0].Target]++
+	}
+	if hits["a."] < 700 || hits["b."] == 0 || hits["a."]+hits["b."]+hits["z."] != 1000 {
+		t.Fatal(20, hits)
+	}
+}
+
+func TestParseCAA(t *testing.T) {
+	c, err := parseCAA(append([]byte{0x80, 5}, "issueletsencrypt.org"...))
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	if !c.Critical() || c.Tag != "issue" || c.Value != "letsencrypt.org" {
+		t.Fatal(20, c)
+	}
+
+	for i, b := range [][]byte{nil, {0}, {0, 0}, {0, 5, 'i'}} {
+		if _, err := parseCAA(b); err == nil {
+			t.Fatal(30, i)
+		}
+	}
+
+	x, err := parseTLSA([]byte{3, 1, 1, 0xaa})
+	if err != nil || x.Usage != 3 || x.Selector != 1 || x.MatchingType != 1 || len(x.Certificate) != 1 {
+		t.Fatal(40, x, err)
+	}
+}
+
+func TestNetResolver(t *testing.T) {
+	c := resolv.NewConf()
+	r := &Resolver{log: dns.NoLogger}
+	r.getQueryConf = func() *queryConf {
+		return &queryConf{Conf: c, Resolver: r, hosts: map[string][]net.IP{"localhost.": {net.IPv4(127, 0, 0, 1)}}}
+	}
+	n := NewNetResolver(r)
+	addrs, err := n.LookupHost(context.Background(), "localhost.")
+	if err != nil || len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+		t.Fatal(10, addrs, err)
+	}
+
+	ips, err := n.LookupIPAddr(context.Background(), "::1")
+	if err != nil || len(ips) != 1 || !ips[0].IP.Equal(net.IPv6loopback) {
+		t.Fatal(20, ips, err)
+	}
+
+	if _, err := n.LookupAddr(context.Background(), "bogus"); err == nil {
+		t.Fatal(30)
+	}
+
+	e := dnsError(context.Background(), "x.", LookupNameError, nil).(*net.DNSError)
+	if !e.IsNotFound || e.IsTemporary || e.Name != "x." {
+		t.Fatal(40, e)
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	<-ctx.Done()
+	if e = dnsError(ctx, "x.", LookupFail, ctx.Err()).(*net.DNSError); !e.IsTimeout {
+		t.Fatal(50, e)
+	}
+
+	ns := func(query *msg.Message, remote net.Addr) *msg.Message {
+		query.QR, query.RA, query.Additional = true, true, nil
+		switch query.Question[0].QNAME {
+		case "1.2.0.192.in-addr.arpa.":
+			query.RCODE = msg.RC_NAME_ERROR
+		case "2.2.0.192.in-addr.arpa.":
+			query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_PTR, rr.CLASS_IN, 60, &rr.PTR{"host.example."}}}
+		case "www.":
+			query.RCODE = msg.RC_NAME_ERROR
+		case "www.example.":
+			query.Answer = rr.RRs{
+				&rr.RR{"www.example.", rr.TYPE_CNAME, rr.CLASS_IN, 60, &rr.CNAME{"web.example."}},
+				&rr.RR{"web.example.", rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 80)}},
+			}
+		case "_sip._udp.example.":
+			query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_SRV, rr.CLASS_IN, 60, &rr.SRV{0, 0, 0, "."}}}
+		default:
+			query.RCODE = msg.RC_SERVER_FAILURE
+		}
+		return query
+	}
+	if err := c.LoadString("test", "nameserver 192.0.2.53\nsearch example\n"); err != nil {
+		t.Fatal(60, err)
+	}
+
+	r.cache, r.flights, r.stats = cache.New(), newFlights(), newServerStats()
+	r.SetTransport(transport.MemNet{"192.0.2.53": msg.ResponderFunc(ns)}.Factory)
+	names, err := n.LookupAddr(context.Background(), "192.0.2.2")
+	if err != nil || len(names) != 1 || names[0] != "host.example." {
+		t.Fatal(70, names, err)
+	}
+
+	for i, test := range []struct {
+		addr                string
+		notFound, temporary bool
+	}{
+		{"192.0.2.1", true, false},
+		{"192.0.2.3", false, true},
+	} {
+		_, err := n.LookupAddr(context.Background(), test.addr)
+		if e, ok := err.(*net.DNSError); !ok || e.IsNotFound != test.notFound || e.IsTemporary != test.temporary {
+			t.Fatal(80, i, err)
+		}
+	}
+
+	if _, err := n.LookupAddr(ctx, "192.0.2.2"); err.(*net.DNSError).IsNotFound || !err.(*net.DNSError).IsTimeout {
+		t.Fatal(90, err)
+	}
+
+	if cname, err := n.LookupCNAME(context.Background(), "www"); err != nil || cname != "web.example." {
+		t.Fatal(100, cname, err)
+	}
+
+	if cname, srv, err := n.LookupSRV(context.Background(), "sip", "udp", "example."); err == nil || !err.(*net.DNSError).IsNotFound {
+		t.Fatal(110, cname, srv, err)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	r := &Resolver{cache: cache.New(), log: dns.NoLogger}
+	r.cache.Add(rr.RRs{
+		&rr.RR{"www.example.com.", rr.TYPE_CNAME, rr.CLASS_IN, 3600, &rr.CNAME{"example.com."}},
+		&rr.RR{"example.com.", rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 1)}},
+	})
+	answer, redirects, result, tr, err := r.LookupTrace(context.Background(), "www.example.com.", msg.QTYPE_A, rr.CLASS_IN, false)
+	if err != nil || result != LookupAliased || len(answer) != 1 || len(redirects) != 1 {
+		t.Fatal(10, answer, redirects, result, err)
+	}
+
+	steps := tr.Steps()
+	if len(steps) != 3 {
+		t.Fatal(20, tr)
+	}
+
+	for i, e := range []TraceKind{TraceCache, TraceCache, TraceResult} {
+		if g := steps[i].Kind; g != e {
+			t.Fatal(30, i, g, e)
+		}
+	}
+
+	if steps[0].Note != "CNAME" || steps[2].Result != LookupAliased || steps[2].Name != "www.example.com." {
+		t.Fatal(40, tr)
+	}
+
+	if s := tr.String(); !strings.Contains(s, "cache www.example.com.") || !strings.Contains(s, "canonical name") {
+		t.Fatal(50, s)
+	}
+}
+
+func TestDNS64Embedding(t *testing.T) {
+	ip4 := net.IPv4(192, 0, 2, 33)
+	for i, test := range []struct {
+		prefix, e string
+	}{ // rfc6052/2.4
+		{"2001:db8::/32", "2001:db8:c000:221::"},
+		{"2001:db8:100::/40", "2001:db8:1c0:2:21::"},
+		{"2001:db8:122::/48", "2001:db8:122:c000:2:2100::"},
+		{"2001:db8:122:300::/56", "2001:db8:122:3c0:0:221::"},
+		{"2001:db8:122:344::/64", "2001:db8:122:344:c0:2:2100:0"},
+		{"2001:db8:122:344::/96", "2001:db8:122:344::c000:221"},
+	} {
+		_, prefix, err := net.ParseCIDR(test.prefix)
+		if err != nil {
+			t.Fatal(10, i, err)
+		}
+
+		r := &Resolver{}
+		if err = r.SetDNS64(&DNS64{Prefix: prefix}); err != nil {
+			t.Fatal(20, i, err)
+		}
+
+		d := r.DNS64()
+		ip6 := d.Synthesize(ip4)
+		if g := ip6.String(); g != test.e {
+			t.Fatal(30, i, g, test.e)
+		}
+
+		if g := d.Extract(ip6); !g.Equal(ip4) {
+			t.Fatal(40, i, g)
+		}
+
+		if g := ip6ArpaIP(dns.RevLookupName(ip6)); !g.Equal(ip6) {
+			t.Fatal(50, i, g)
+		}
+	}
+
+	r := &Resolver{}
+	_, bad, _ := net.ParseCIDR("2001:db8::/33")
+	if err := r.SetDNS64(&DNS64{Prefix: bad}); err == nil {
+		t.Fatal(60)
+	}
+
+	if ip6ArpaIP("1.0.0.127.in-addr.arpa.") != nil || ip6ArpaIP("x.ip6.arpa.") != nil {
+		t.Fatal(70)
+	}
+}
+
+func TestDNS64Lookup(t *testing.T) {
+	r := &Resolver{cache: cache.New(), log: dns.NoLogger}
+	if err := r.SetDNS64(&DNS64{}); err != nil {
+		t.Fatal(10, err)
+	}
+
+	r.cache.Add(rr.RRs{
+		&rr.RR{"v4.example.", rr.TYPE_NODATA, rr.CLASS_IN, 300, &rr.NODATA{rr.TYPE_AAAA}},
+		&rr.RR{"v4.example.", rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 33)}},
+		&rr.RR{"mapped.example.", rr.TYPE_AAAA, rr.CLASS_IN, 3600, &rr.AAAA{net.ParseIP("::ffff:192.0.2.34")}},
+		&rr.RR{"mapped.example.", rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 34)}},
+		&rr.RR{"33.2.0.192.in-addr.arpa.", rr.TYPE_PTR, rr.CLASS_IN, 3600, &rr.PTR{"v4.example."}},
+	})
+	answer, _, result, err := r.Lookup("v4.example.", msg.QTYPE_AAAA, rr.CLASS_IN, false)
+	if err != nil || result != LookupOK || len(answer) != 1 {
+		t.Fatal(20, answer, result, err)
+	}
+
+	if g, e := answer[0].RData.(*rr.AAAA).Address.String(), "64:ff9b::c000:221"; g != e {
+		t.Fatal(30, g, e)
+	}
+
+	if g := answer[0].TTL; g > 300 || g < 290 {
+		t.Fatal(40, g)
+	}
+
+	answer, _, result, err = r.Lookup("mapped.example.", msg.QTYPE_AAAA, rr.CLASS_IN, false)
+	if err != nil || result != LookupOK || len(answer) != 1 || answer[0].TTL != dns64MaxTTL {
+		t.Fatal(50, answer, result, err)
+	}
+
+	answer, redirects, result, err := r.Lookup(dns.RevLookupName(net.ParseIP("64:ff9b::c000:221")), msg.QTYPE_PTR, rr.CLASS_IN, false)
+	if err != nil || result != LookupAliased || len(answer) != 1 || len(redirects) != 1 {
+		t.Fatal(60, answer, redirects, result, err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	for i, test := range []struct {
+		name, zone string
+		e          bool
+	}{
+		{"example.com.", ".", true},
+		{"example.com.", "com.", true},
+		{"Example.COM.", "example.com", true},
+		{"www.example.com.", "example.com.", true},
+		{"example.com.", "www.example.com.", false},
+		{"badexample.com.", "example.com.", false},
+		{"example.net.", "com.", false},
+	} {
+		if g := inBailiwick(test.name, test.zone); g != test.e {
+			t.Fatal(10, i, g, test.e)
+		}
+	}
+
+	ns := func(owner, target string) *rr.RR {
+		return &rr.RR{owner, rr.TYPE_NS, rr.CLASS_IN, 3600, &rr.NS{target}}
+	}
+	a := func(owner string, ip net.IP) *rr.RR {
+		return &rr.RR{owner, rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{ip}}
+	}
+	reply := &msg.Message{
+		Authority: rr.RRs{
+			ns("example.com.", "ns.example.com."),
+			ns("example.com.", "ns.example.net."),
+			ns("net.", "ns.evil.com."), // out of zone
+		},
+		Additional: rr.RRs{
+			a("ns.example.com.", net.IPv4(192, 0, 2, 1)),
+			a("ns.example.net.", net.IPv4(192, 0, 2, 2)),  // out of zone
+			a("www.example.com.", net.IPv4(192, 0, 2, 3)), // not glue
+		},
+	}
+	answer, authority, additional, dropped := scrub(reply, "com.")
+	if len(answer) != 0 || len(authority) != 2 || len(additional) != 1 || dropped != 3 {
+		t.Fatal(20, answer, authority, additional, dropped)
+	}
+
+	if g := additional[0].Name; g != "ns.example.com." {
+		t.Fatal(30, g)
+	}
+
+	r := &Resolver{cache: cache.New()}
+	r.cacheReply(true, rr.RRs{a("ns.example.com.", net.IPv4(192, 0, 2, 10))}, nil, nil, nil)
+	r.cacheReply(false, nil, nil, authority, additional)
+	found, hit := r.cache.Get("ns.example.com.")
+	if !hit || len(found) != 1 || !found[0].RData.(*rr.A).Address.Equal(net.IPv4(192, 0, 2, 10)) {
+		t.Fatal(40, hit, found)
+	}
+
+	if rank, _ := r.cache.Rank("example.com.", rr.TYPE_NS); rank != cache.RankAdditional {
+		t.Fatal(50, rank)
+	}
+}
+
+func TestCaseRandomisation(t *testing.T) {
+	const name = "www.example.com."
+	mixed := false
+	for i := 0; i < 10; i++ {
+		x := randomCase(name)
+		if !strings.EqualFold(x, name) {
+			t.Fatal(10, x)
+		}
+
+		mixed = mixed || x != name
+	}
+	if !mixed {
+		t.Fatal(20)
+	}
+
+	query := newQuery("wWw.ExAmple.cOm.", msg.QTYPE_A, rr.CLASS_IN, false, false)
+	reply := newQuery("www.example.com.", msg.QTYPE_A, rr.CLASS_IN, false, false)
+	reply.Answer = rr.RRs{&rr.RR{"WWW.example.com.", rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 1)}}}
+	if err := checkQuestion(query, reply, false); err != nil {
+		t.Fatal(30, err)
+	}
+
+	if err := checkQuestion(query, reply, true); err == nil {
+		t.Fatal(40)
+	}
+
+	reply.Question[0].QNAME = query.Question[0].QNAME
+	if err := checkQuestion(query, reply, true); err != nil {
+		t.Fatal(50, err)
+	}
+
+	reply.Answer = append(reply.Answer,
+		&rr.RR{"mail.wWw.ExAmple.cOm.", rr.TYPE_CNAME, rr.CLASS_IN, 60, &rr.CNAME{"Host.wWw.ExAmple.cOm."}},
+		&rr.RR{"xwWw.ExAmple.cOm.", rr.TYPE_MX, rr.CLASS_IN, 60, &rr.MX{10, "wWw.ExAmple.cOm."}},
+	)
+	reply.Authority = rr.RRs{&rr.RR{"wWw.ExAmple.cOm.", rr.TYPE_SOA, rr.CLASS_IN, 60, &rr.SOA{"ns.wWw.ExAmple.cOm.", "Hostmaster.wWw.ExAmple.cOm.", 1, 3600, 600, 86400, 300}}}
+	uncase(query, reply)
+	if g, e := reply.Answer[0].Name, name; g != e {
+		t.Fatal(60, g, e)
+	}
+
+	if g, e := fmt.Sprint(reply.Answer[1], reply.Answer[2], reply.Authority[0]), fmt.Sprint(
+		&rr.RR{"mail.www.example.com.", rr.TYPE_CNAME, rr.CLASS_IN, 60, &rr.CNAME{"Host.www.example.com."}},
+		&rr.RR{"xwWw.ExAmple.cOm.", rr.TYPE_MX, rr.CLASS_IN, 60, &rr.MX{10, "www.example.com."}},
+		&rr.RR{"www.example.com.", rr.TYPE_SOA, rr.CLASS_IN, 60, &rr.SOA{"ns.www.example.com.", "Hostmaster.www.example.com.", 1, 3600, 600, 86400, 300}},
+	); g != e {
+		t.Fatalf("65\n%s\n%s", g, e)
+	}
+
+	reply.Question[0].QTYPE = msg.QTYPE_AAAA
+	if err := checkQuestion(query, reply, false); err == nil {
+		t.Fatal(70)
+	}
+}
+
+func TestCookies(t *testing.T) {
+	r := &Resolver{stats: newServerStats()}
+	r.SetCookies(true)
+	ip := net.IPv4(192, 0, 2, 1)
+	m := r.question("example.com.", msg.QTYPE_A, rr.CLASS_IN, false, ednsBufSize, ip)
+	sent, ok := cookie(m)
+	if !ok || len(sent) != clientCookieLen {
+		t.Fatal(10, sent, ok)
+	}
+
+	if c := r.clientCookie(net.IPv4(192, 0, 2, 2)); bytes.Equal(c, sent) {
+		t.Fatal(20, c)
+	}
+
+	srv := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	reply := newQuery("example.com.", msg.QTYPE_A, rr.CLASS_IN, false, false)
+	reply.Additional = rr.RRs{&rr.RR{".", rr.TYPE_OPT, rr.Class(4096), (&rr.EXT_RCODE{RCODE: 1}).ToTTL(), &rr.OPT{[]rr.OPT_DATA{{optCookie, append(append([]byte(nil), sent...), srv...)}}}}}
+	reply.RCODE = 7
+	if g, e := extRCODE(reply), rcodeBADCOOKIE; g != e {
+		t.Fatal(30, g, e)
+	}
+
+	if err := r.checkCookie(m, reply, ip); err != nil {
+		t.Fatal(40, err)
+	}
+
+	m = r.question("example.com.", msg.QTYPE_A, rr.CLASS_IN, false, ednsBufSize, ip)
+	if c, _ := cookie(m); !bytes.Equal(c, append(append([]byte(nil), sent...), srv...)) {
+		t.Fatal(50, c)
+	}
+
+	reply.Additional[0].RData.(*rr.OPT).Values[0].Data[0] ^= 1
+	if err := r.checkCookie(m, reply, ip); err == nil {
+		t.Fatal(60)
+	}
+
+	r.SetCookies(false)
+	m = r.question("example.com.", msg.QTYPE_A, rr.CLASS_IN, false, ednsBufSize, ip)
+	if _, ok := cookie(m); ok {
+		t.Fatal(70)
+	}
+}
+
+func TestBADCOOKIE(t *testing.T) {
+	srv := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	var bad int // number of BADCOOKIE replies to send
+	var log []string
+	factory := func(network string, ip net.IP) (transport.Exchanger, error) {
+		return exchangeFunc(func(ctx context.Context, m *msg.Message) (*msg.Message, error) {
+			c, _ := cookie(m)
+			log = append(log, fmt.Sprintf("%s %t", network, bytes.HasSuffix(c, srv)))
+			reply := *m
+			reply.QR = true
+			ext := rr.EXT_RCODE{}
+			if bad != 0 {
+				bad--
+				reply.RCODE, ext.RCODE = rcodeBADCOOKIE&0xf, rcodeBADCOOKIE>>4
+			} else {
+				reply.Answer = rr.RRs{&rr.RR{m.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 80)}}}
+			}
+			data := append(append([]byte(nil), c[:clientCookieLen]...), srv...)
+			reply.Additional = rr.RRs{&rr.RR{".", rr.TYPE_OPT, rr.Class(ednsBufSize), ext.ToTTL(), &rr.OPT{[]rr.OPT_DATA{{optCookie, data}}}}}
+			return &reply, nil
+		}), nil
+	}
+	ip := net.IPv4(192, 0, 2, 1)
+	for i, test := range []struct {
+		bad int
+		log string
+		ok  bool
+	}{
+		{1, "[udp false udp true]", true},
+		{2, "[udp true udp true tcp true]", true},
+		{3, "[udp true udp true tcp true]", false},
+	} {
+		r := &Resolver{log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+		r.SetCookies(true)
+		r.SetTransport(factory)
+		if i != 0 {
+			r.stats.setServerCookie(ip, srv)
+		}
+		bad, log = test.bad, nil
+		reply, err := r.ask(context.Background(), "udp", "example.com.", msg.QTYPE_A, rr.CLASS_IN, false, ip, time.Second)
+		if g := fmt.Sprint(log); g != test.log {
+			t.Fatal(10, i, g, test.log)
+		}
+
+		if ok := err == nil && len(reply.Answer) == 1; ok != test.ok {
+			t.Fatal(20, i, reply, err)
+		}
+	}
+}
+
+func TestDNAME(t *testing.T) {
+	dname := func(owner, target string) *rr.RR {
+		return &rr.RR{owner, rr.TYPE_DNAME, rr.CLASS_IN, 3600, &rr.DNAME{target}}
+	}
+
+	for i, test := range []struct {
+		qname, owner, target, e string
+		ok                      bool
+	}{
+		{"www.example.com.", "example.com.", "example.net.", "www.example.net.", true},
+		{"a.b.example.com.", "example.com.", "Example.NET.", "a.b.example.net.", true},
+		{"www.example.com.", "example.com.", ".", "www.", true},
+		{"www.example.", ".", "example.net.", "www.example.example.net.", true},
+		{strings.Repeat("x", 63) + ".example.", "example.", strings.Repeat(strings.Repeat("y", 63)+".", 3), "", false},
+	} {
+		g, ok := substitute(test.qname, dname(test.owner, test.target))
+		if ok != test.ok || ok && g != test.e {
+			t.Fatal(10, i, g, ok, test.e, test.ok)
+		}
+	}
+
+	if dnameFor(rr.RRs{dname("www.example.com.", "example.net.")}, "www.example.com.", rr.CLASS_IN) != nil {
+		t.Fatal(20)
+	}
+
+	r := &Resolver{cache: cache.New(), log: dns.NoLogger}
+	r.cache.Add(rr.RRs{
+		dname("example.com.", "example.net."),
+		{"www.example.net.", rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 1)}},
+		dname("a.example.", "b.example."),
+		dname("b.example.", "a.example."),
+		dname("long.example.", strings.Repeat(strings.Repeat("y", 63)+".", 3)),
+		dname("tld.", "example.net."),
+	})
+	answer, redirects, result, err := r.Lookup("WWW.example.com.", msg.QTYPE_A, rr.CLASS_IN, false)
+	if err != nil || result != LookupAliased || len(answer) != 1 || len(redirects) != 2 {
+		t.Fatal(30, answer, redirects, result, err)
+	}
+
+	if redirects[0].Type != rr.TYPE_DNAME || redirects[1].Name != "www.example.com." || redirects[1].RData.(*rr.CNAME).Name != "www.example.net." {
+		t.Fatal(40, redirects)
+	}
+
+	if _, _, result, err = r.Lookup("www.a.example.", msg.QTYPE_A, rr.CLASS_IN, false); err != nil || result != LookupAliasLoop {
+		t.Fatal(50, result, err)
+	}
+
+	if _, _, result, err = r.Lookup(strings.Repeat("x", 63)+".long.example.", msg.QTYPE_A, rr.CLASS_IN, false); err != nil || result != LookupYXDomain {
+		t.Fatal(60, result, err)
+	}
+
+	answer, redirects, result, err = r.Lookup("www.tld.", msg.QTYPE_A, rr.CLASS_IN, false)
+	if err != nil || result != LookupAliased || len(answer) != 1 || len(redirects) != 2 || redirects[0].Name != "tld." {
+		t.Fatal(70, answer, redirects, result, err)
+	}
+
+	for i, name := range []string{"www.tld.", "www.tld", "a.www.tld"} {
+		if x := r.cachedDNAME(name, rr.CLASS_IN); x == nil || x.Name != "tld." {
+			t.Fatal(80, i, x)
+		}
+	}
+}
+
+func TestSetDoT(t *testing.T) {
+	r := &Resolver{}
+	ip := net.IPv4(192, 0, 2, 1)
+	if r.DoT() != nil || r.dotClient(ip) != nil {
+		t.Fatal(10)
+	}
+
+	d := &DoT{}
+	r.SetDoT(d)
+	if r.DoT() != d {
+		t.Fatal(20)
+	}
+
+	c := r.dotClient(ip)
+	if c == nil || c.Addr() != "192.0.2.1:853" || r.dotClient(ip) != c {
+		t.Fatal(30, c)
+	}
+
+	r.SetDoT(nil)
+	if r.DoT() != nil || r.dotClient(ip) != nil {
+		t.Fatal(40)
+	}
+
+	if _, err := r.exchanger("tls", ip); err != errDoTOff {
+		t.Fatal(50, err)
+	}
+}
+
+func TestSetDoH(t *testing.T) {
+	srv := httptest.NewTLSServer(&doh.Handler{msg.ResponderFunc(func(query *msg.Message, remote net.Addr) *msg.Message {
+		query.QR = true
+		query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 1)}}}
+		return query
+	})})
+	defer srv.Close()
+
+	r := &Resolver{log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+	ip := net.IPv4(192, 0, 2, 53)
+	m := newQuery("example.com.", msg.QTYPE_A, rr.CLASS_IN, true, false)
+	if _, err := r.query(context.Background(), "https", m, ip, time.Second, true); err != errDoHOff {
+		t.Fatal(10, err)
+	}
+
+	r.SetDoH(doh.NewHTTPClient(srv.URL, srv.Client()))
+	reply, err := r.ask(context.Background(), "https", "example.com.", msg.QTYPE_A, rr.CLASS_IN, true, ip, time.Second)
+	if err != nil || len(reply.Answer) != 1 {
+		t.Fatal(20, reply, err)
+	}
+
+	r.SetDoH(nil)
+	if r.DoH() != nil {
+		t.Fatal(30)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	soa := &rr.RR{"example.", rr.TYPE_SOA, rr.CLASS_IN, 3600, &rr.SOA{"ns.example.", "hostmaster.example.", 1, 3600, 600, 86400, 300}}
+	var queries int32
+	root := func(query *msg.Message, remote net.Addr) *msg.Message {
+		atomic.AddInt32(&queries, 1)
+		query.QR = true
+		query.Authority = rr.RRs{&rr.RR{"example.", rr.TYPE_NS, rr.CLASS_IN, 3600, &rr.NS{"ns.example."}}}
+		query.Additional = rr.RRs{&rr.RR{"ns.example.", rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 1)}}}
+		return query
+	}
+	zone := func(query *msg.Message, remote net.Addr) *msg.Message {
+		atomic.AddInt32(&queries, 1)
+		q := query.Question[0]
+		query.QR, query.AA, query.Additional = true, true, nil
+		switch {
+		case strings.ToLower(q.QNAME) == "www.example." && q.QTYPE == msg.QTYPE_A:
+			query.Answer = rr.RRs{&rr.RR{"www.example.", rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 80)}}}
+		default:
+			query.Authority = rr.RRs{soa}
+		}
+		return query
+	}
+
+	c := resolv.NewConf()
+	if err := c.LoadString("test", "nameserver 192.0.2.2\n"); err != nil {
+		t.Fatal(10, err)
+	}
+
+	r := &Resolver{cache: cache.New(), log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+	r.getQueryConf = func() *queryConf { return &queryConf{Conf: c, Resolver: r} }
+	mem := transport.MemNet{
+		"192.0.2.1": msg.ResponderFunc(zone),
+		"192.0.2.2": msg.ResponderFunc(root),
+	}
+	r.SetTransport(mem.Factory)
+	if r.Transport() == nil {
+		t.Fatal(15)
+	}
+
+	answer, _, result, err := r.Lookup("www.example.", msg.QTYPE_A, rr.CLASS_IN, false)
+	if err != nil || result != LookupOK || len(answer) != 1 || answer[0].RData.(*rr.A).Address.String() != "192.0.2.80" {
+		t.Fatal(20, answer, result, err)
+	}
+
+	n := atomic.LoadInt32(&queries)
+	if n < 2 {
+		t.Fatal(30, n)
+	}
+
+	if _, _, result, err = r.Lookup("www.example.", msg.QTYPE_A, rr.CLASS_IN, false); err != nil || result != LookupOK || atomic.LoadInt32(&queries) != n {
+		t.Fatal(40, result, err, atomic.LoadInt32(&queries), n)
+	}
+
+	if _, _, result, err = r.Lookup("ftp.example.", msg.QTYPE_A, rr.CLASS_IN, false); err != nil || result != LookupDataNotFound {
+		t.Fatal(50, result, err)
+	}
+
+	r.SetTransport(nil)
+	if r.Transport() != nil {
+		t.Fatal(60)
+	}
+
+	if _, err := r.exchanger("https", net.IPv4(192, 0, 2, 1)); err != errDoHOff {
+		t.Fatal(70, err)
+	}
+}
+
+func TestForwarders(t *testing.T) {
+	answer := func(query *msg.Message, remote net.Addr) *msg.Message {
+		query.QR, query.RA, query.Additional = true, true, nil
+		query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 80)}}}
+		return query
+	}
+	servfail := func(query *msg.Message, remote net.Addr) *msg.Message {
+		query.QR, query.RA, query.Additional = true, true, nil
+		query.RCODE = msg.RC_SERVER_FAILURE
+		return query
+	}
+
+	c := resolv.NewConf()
+	if err := c.LoadString("test", "nameserver 192.0.2.3\n"); err != nil {
+		t.Fatal(10, err)
+	}
+
+	mem := transport.MemNet{
+		"192.0.2.1": msg.ResponderFunc(servfail),
+		"192.0.2.2": msg.ResponderFunc(answer),
+		"192.0.2.3": msg.ResponderFunc(answer),
+		"192.0.2.4": msg.ResponderFunc(servfail),
+	}
+	r := &Resolver{cache: cache.New(), log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+	r.getQueryConf = func() *queryConf { return &queryConf{Conf: c, Resolver: r} }
+	r.SetTransport(mem.Factory)
+	for i, test := range []struct {
+		forward    named.Forward
+		forwarders []net.IP
+		result     LookupResult
+	}{
+		{named.ForwardOnly, []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)}, LookupOK},
+		{named.ForwardOnly, []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 4)}, LookupFail},
+		{named.ForwardFirst, []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 4)}, LookupOK},
+	} {
+		r.cache = cache.New()
+		r.SetForwarding(Forwarding{Domain: ".", Forward: test.forward, Forwarders: test.forwarders})
+		answer, _, result, err := r.Lookup("www.example.", msg.QTYPE_A, rr.CLASS_IN, false)
+		if err != nil || result != test.result || result == LookupOK && len(answer) != 1 {
+			t.Fatal(20, i, answer, result, err)
+		}
+	}
+}
+
+func TestYXDomain(t *testing.T) {
+	root := func(query *msg.Message, remote net.Addr) *msg.Message {
+		query.QR = true
+		query.Authority = rr.RRs{&rr.RR{"example.", rr.TYPE_NS, rr.CLASS_IN, 3600, &rr.NS{"ns.example."}}}
+		query.Additional = rr.RRs{&rr.RR{"ns.example.", rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 1)}}}
+		return query
+	}
+	zone := func(query *msg.Message, remote net.Addr) *msg.Message {
+		query.QR, query.AA, query.Additional = true, true, nil
+		switch strings.ToLower(query.Question[0].QNAME) {
+		case "www.example.":
+			query.Answer = rr.RRs{&rr.RR{"www.example.", rr.TYPE_CNAME, rr.CLASS_IN, 3600, &rr.CNAME{"long.example."}}}
+		default:
+			query.RCODE = msg.RC_YXDOMAIN
+		}
+		return query
+	}
+
+	c := resolv.NewConf()
+	if err := c.LoadString("test", "nameserver 192.0.2.2\n"); err != nil {
+		t.Fatal(10, err)
+	}
+
+	r := &Resolver{cache: cache.New(), log: dns.NoLogger, flights: newFlights(), stats: newServerStats()}
+	r.getQueryConf = func() *queryConf { return &queryConf{Conf: c, Resolver: r} }
+	mem := transport.MemNet{
+		"192.0.2.1": msg.ResponderFunc(zone),
+		"192.0.2.2": msg.ResponderFunc(root),
+	}
+	r.SetTransport(mem.Factory)
+	_, redirects, result, err := r.Lookup("www.example.", msg.QTYPE_A, rr.CLASS_IN, false)
+	if err != nil || result != LookupYXDomain || len(redirects) != 1 {
+		t.Fatal(20, redirects, result, err)
+	}
+
+	if st := r.ServerStats()["192.0.2.1"]; st.Lame != 0 {
+		t.Fatal(30, &st)
+	}
+}
+
+func TestReplyWire(t *testing.T) {
+	answer := func(query *msg.Message, remote net.Addr) *msg.Message {
+		query.QR, query.RA, query.Additional = true, true, nil
+		query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 3600, &rr.A{net.IPv4(192, 0, 2, 80)}}}
+		return query
+	}
+
+	c := resolv.NewConf()
+	if err := c.LoadString("test", "nameserver 192.0.2.1\n"); err != nil {
+		t.Fatal(10, err)
+	}
+
+	var buf bytes.Buffer
+	r := &Resolver{cache: cache.New(), log: dns.NewLogger(log.New(&buf, "", 0), dns.LOG_DEBUG), flights: newFlights(), stats: newServerStats()}
+	r.getQueryConf = func() *queryConf { return &queryConf{Conf: c, Resolver: r} }
+	r.SetTransport(transport.MemNet{"192.0.2.1": msg.ResponderFunc(answer)}.Factory)
+	r.SetForwarding(Forwarding{Domain: ".", Forward: named.ForwardOnly, Forwarders: []net.IP{net.IPv4(192, 0, 2, 1)}})
+	if _, _, result, err := r.Lookup("www.example.", msg.QTYPE_A, rr.CLASS_IN, false); err != nil || result != LookupOK {
+		t.Fatal(20, result, err)
+	}
+
+	s := buf.String()
+	i := strings.Index(s, "(REPLY MSG from")
+	if i < 0 {
+		t.Fatal(30, s)
+	}
+
+	if !strings.Contains(s[i:], "\nWire:\n00000000  ") {
+		t.Fatal(40, s[i:])
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/cache"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"strings"
+)
+
+// inBailiwick returns whether name is zone or a name below zone.
+func inBailiwick(name, zone string) bool {
+	name, zone = strings.ToLower(dns.RootedName(name)), strings.ToLower(dns.RootedName(zone))
+	return zone == "." || name == zone || strings.HasSuffix(name, "."+zone)
+}
+
+// scrub returns the parts of reply which a server authoritative for zone may
+// be trusted with. Out of zone records are dropped from all sections. The
+// additional section keeps only the in zone addresses of the name servers
+// listed in the answer or authority sections, i.e. glue. The returned dropped
+// is the number of records left out.
+func scrub(reply *msg.Message, zone string) (answer, authority, additional rr.RRs, dropped int) {
+	in := func(rec *rr.RR) bool {
+		return inBailiwick(rec.Name, zone)
+	}
+	var out rr.RRs
+	answer, out = reply.Answer.Filter(in)
+	dropped += len(out)
+	authority, out = reply.Authority.Filter(in)
+	dropped += len(out)
+
+	nsdnames := map[string]bool{}
+	for _, part := range []rr.RRs{answer, authority} {
+		for _, rec := range part {
+			if rec.Type == rr.TYPE_NS {
+				nsdnames[strings.ToLower(dns.RootedName(rec.RData.(*rr.NS).NSDName))] = true
+			}
+		}
+	}
+	for _, rec := range reply.Additional {
+		switch rec.Type {
+		case rr.TYPE_A, rr.TYPE_AAAA:
+			if in(rec) && nsdnames[strings.ToLower(dns.RootedName(rec.Name))] {
+				additional = append(additional, rec)
+				continue
+			}
+		case rr.TYPE_OPT:
+			continue
+		}
+
+		dropped++
+	}
+	return
+}
+
+// cacheReply caches the parts of a reply at their rfc2181/5.4.1 credibility.
+// aa is the AA flag of the reply.
+func (r *Resolver) cacheReply(aa bool, answer, soas, ns, additional rr.RRs) {
+	ansRank, authRank := cache.RankAnswer, cache.RankAdditional
+	if aa {
+		ansRank, authRank = cache.RankAuthAnswer, cache.RankAuthority
+	}
+	r.cache.AddRank(ansRank, answer)
+	r.cache.AddRank(authRank, soas, ns)
+	r.cache.AddRank(cache.RankAdditional, additional)
+}
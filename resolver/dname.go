@@ -0,0 +1,112 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/rr"
+	"strings"
+)
+
+const maxNameLen = 255 // rfc1035/2.3.4, in octets of the wire format
+
+// wireLen returns the length of the uncompressed wire format of name.
+func wireLen(name string) (n int) {
+	name = dns.RootedName(name)
+	if name == "." {
+		return 1
+	}
+
+	return len(name) + 1
+}
+
+// substitute performs the DNAME substitution of qname (rfc6672/2.2). dname
+// must be owned by a proper ancestor of qname. The returned ok is false if
+// the result exceeds the maximum name length, i.e. the YXDOMAIN case.
+func substitute(qname string, dname *rr.RR) (y string, ok bool) {
+	owner := strings.ToLower(dns.RootedName(dname.Name))
+	target := dns.RootedName(dname.RData.(*rr.DNAME).Name)
+	prefix := qname[:len(qname)-len(owner)] // "www." of "www.example.com."
+	if owner == "." {
+		prefix = qname
+	}
+	switch {
+	case target == ".":
+		y = prefix
+	default:
+		y = prefix + target
+	}
+	y = strings.ToLower(y)
+	return y, wireLen(y) <= maxNameLen
+}
+
+// synthCNAME returns the CNAME synthesized from dname for qname, having the
+// TTL of dname (rfc6672/3.4).
+func synthCNAME(dname *rr.RR, qname, target string) *rr.RR {
+	return &rr.RR{qname, rr.TYPE_CNAME, dname.Class, dname.TTL, &rr.CNAME{target}}
+}
+
+// properAncestor returns whether name is below owner.
+func properAncestor(owner, name string) bool {
+	owner, name = strings.ToLower(dns.RootedName(owner)), strings.ToLower(dns.RootedName(name))
+	return owner != name && inBailiwick(name, owner)
+}
+
+// dnameFor returns the DNAME of rrs which applies to qname, if any. The
+// closest one is used if there are more of them.
+func dnameFor(rrs rr.RRs, qname string, class rr.Class) (y *rr.RR) {
+	for _, rec := range rrs {
+		if rec.Type != rr.TYPE_DNAME || rec.Class != class || !properAncestor(rec.Name, qname) {
+			continue
+		}
+
+		if y == nil || len(rec.Name) > len(y.Name) {
+			y = rec
+		}
+	}
+	return
+}
+
+// cachedDNAME returns the cached DNAME owned by the closest proper ancestor of
+// qname, if any.
+func (r *Resolver) cachedDNAME(qname string, class rr.Class) *rr.RR {
+	labels, err := dns.Labels(qname)
+	if err != nil {
+		return nil
+	}
+
+	for i := 1; i < len(labels); i++ { // labels end with "" only if qname is rooted
+		owner := dns.RootedName(strings.Join(labels[i:], "."))
+		if x := dnameFor(r.cached(owner, func(rec *rr.RR) bool { return rec.Type == rr.TYPE_DNAME }), qname, class); x != nil {
+			return x
+		}
+	}
+	return nil
+}
+
+// dname applies dname to *sname and appends dname and the synthesized CNAME
+// to *redirects. The returned result is LookupAliased if *sname was replaced
+// by the substitution, LookupYXDomain or LookupAliasLoop otherwise.
+func (r *Resolver) dname(dname *rr.RR, sname *string, aliases map[string]bool, redirects *rr.RRs) (result LookupResult) {
+	target, ok := substitute(*sname, dname)
+	if !ok {
+		*redirects = append(*redirects, dname)
+		return LookupYXDomain
+	}
+
+	*redirects = append(*redirects, dname, synthCNAME(dname, *sname, target))
+	if aliases[target] {
+		return LookupAliasLoop
+	}
+
+	if r.log.Level >= dns.LOG_DEBUG {
+		r.log.Log("%q: DNAME %q -> %q", *sname, dname.Name, target)
+	}
+	aliases[target] = true
+	*sname = target
+	return LookupAliased
+}
@@ -0,0 +1,254 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// WellKnownPrefix is the NAT64 Well-Known Prefix 64:ff9b::/96 (rfc6052/2.1).
+var WellKnownPrefix = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+// DNS64 configures the synthesis of AAAA RRs from A RRs (rfc6147).
+type DNS64 struct {
+	// The NAT64 prefix. Its length must be one of 32, 40, 48, 56, 64 or
+	// 96 (rfc6052/2.2). If nil, WellKnownPrefix is used.
+	Prefix *net.IPNet
+	// AAAA RRs with an address in any of Exclude are treated as if they
+	// do not exist (rfc6147/5.1.4). If nil, ::ffff:0:0/96 is excluded.
+	Exclude []*net.IPNet
+	// IPv4 addresses in any of ExcludeA are not mapped to IPv6 (rfc6147/5.1.6).
+	ExcludeA []*net.IPNet
+}
+
+var defaultExclude = []*net.IPNet{{IP: net.ParseIP("::ffff:0:0"), Mask: net.CIDRMask(96, 128)}}
+
+// dns64MaxTTL limits the TTL of synthesized AAAA RRs when the SOA of the
+// negative response to the AAAA query is not known (rfc6147/5.1.7).
+const dns64MaxTTL = 600
+
+// SetDNS64 configures DNS64 for r. A nil d turns DNS64 off. With DNS64 on, an
+// IN AAAA lookup of a name which exists but has no (non excluded) AAAA RRs
+// returns AAAA RRs synthesized from the A RRs of the name, and an IN PTR
+// lookup of an ip6.arpa name of an address within the NAT64 prefix is
+// answered by a CNAME to the in-addr.arpa name of the embedded IPv4 address
+// (rfc6147/5.3.1). The DNS64 must not be modified after SetDNS64.
+func (r *Resolver) SetDNS64(d *DNS64) (err error) {
+	if d == nil {
+		r.dns64.Store((*DNS64)(nil))
+		return
+	}
+
+	x := *d
+	if x.Prefix == nil {
+		x.Prefix = WellKnownPrefix
+	}
+	ones, bits := x.Prefix.Mask.Size()
+	switch {
+	case bits != 128:
+		return fmt.Errorf("SetDNS64: invalid prefix %s", x.Prefix)
+	case ones != 32 && ones != 40 && ones != 48 && ones != 56 && ones != 64 && ones != 96:
+		return fmt.Errorf("SetDNS64: unsupported prefix length %d", ones)
+	case ones < 96 && x.Prefix.IP.To16()[8] != 0:
+		return fmt.Errorf("SetDNS64: bits 64 to 71 of prefix %s must be zero", x.Prefix)
+	}
+
+	if x.Exclude == nil {
+		x.Exclude = defaultExclude
+	}
+	r.dns64.Store(&x)
+	return
+}
+
+// DNS64 returns the DNS64 configuration of r or nil if DNS64 is off.
+func (r *Resolver) DNS64() *DNS64 {
+	d, _ := r.dns64.Load().(*DNS64)
+	return d
+}
+
+// dns64Bytes returns the indexes of the IPv6 address bytes holding the
+// embedded IPv4 address for prefix length n (rfc6052/2.2). Byte 8, bits
+// 64 to 71, is always skipped.
+func dns64Bytes(n int) (ix [4]int) {
+	j := n / 8
+	for i := range ix {
+		if j == 8 {
+			j++
+		}
+		ix[i] = j
+		j++
+	}
+	return
+}
+
+// Synthesize returns the IPv6 address embedding the IPv4 address ip4 in the
+// NAT64 prefix of d.
+func (d *DNS64) Synthesize(ip4 net.IP) net.IP {
+	ip4 = ip4.To4()
+	ones, _ := d.Prefix.Mask.Size()
+	y := make(net.IP, net.IPv6len)
+	copy(y, d.Prefix.IP.To16().Mask(d.Prefix.Mask))
+	for i, j := range dns64Bytes(ones) {
+		y[j] = ip4[i]
+	}
+	return y
+}
+
+// Extract returns the IPv4 address embedded in ip6 or nil if ip6 is not
+// within the NAT64 prefix of d.
+func (d *DNS64) Extract(ip6 net.IP) net.IP {
+	if ip6.To4() != nil || !d.Prefix.Contains(ip6) {
+		return nil
+	}
+
+	ip6 = ip6.To16()
+	ones, _ := d.Prefix.Mask.Size()
+	y := make(net.IP, net.IPv4len)
+	for i, j := range dns64Bytes(ones) {
+		y[i] = ip6[j]
+	}
+	return net.IPv4(y[0], y[1], y[2], y[3])
+}
+
+func excluded(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupAAAA64 performs an IN AAAA lookup of sname with DNS64.
+func (r *Resolver) lookupAAAA64(ctx context.Context, d *DNS64, sname string, rd bool) (answer, redirects rr.RRs, result LookupResult, err error) {
+	if answer, redirects, result, err = r.lookup(ctx, sname, msg.QTYPE_AAAA, rr.CLASS_IN, rd); err != nil {
+		return
+	}
+
+	switch result {
+	case LookupOK, LookupAliased:
+		answer, _ = answer.Filter(func(rec *rr.RR) bool {
+			x, ok := rec.RData.(*rr.AAAA)
+			return !ok || !excluded(d.Exclude, x.Address)
+		})
+		if len(answer) != 0 {
+			return
+		}
+	case LookupDataNotFound:
+		// synthesize
+	default:
+		return
+	}
+
+	// rfc6147/5.1.7: the A query is for the end of the CNAME chain
+	name := sname
+	if n := len(redirects); n != 0 {
+		name = redirects[n-1].RData.(*rr.CNAME).Name
+	}
+	a, aredirects, aresult, err := r.lookup(ctx, name, msg.QTYPE_A, rr.CLASS_IN, rd)
+	if err != nil {
+		return nil, redirects, aresult, err
+	}
+
+	redirects = append(redirects, aredirects...)
+	negTTL := r.negativeAAAATTL(name)
+	switch aresult {
+	case LookupOK, LookupAliased:
+		for _, rec := range a {
+			x, ok := rec.RData.(*rr.A)
+			if !ok || excluded(d.ExcludeA, x.Address) {
+				continue
+			}
+
+			ttl := rec.TTL
+			if ttl > negTTL {
+				ttl = negTTL
+			}
+			answer = append(answer, &rr.RR{rec.Name, rr.TYPE_AAAA, rr.CLASS_IN, ttl, &rr.AAAA{d.Synthesize(x.Address)}})
+		}
+	}
+	switch {
+	case len(answer) == 0:
+		result = LookupDataNotFound
+	case len(redirects) != 0:
+		result = LookupAliased
+	default:
+		result = LookupOK
+	}
+	return
+}
+
+// negativeAAAATTL returns the TTL of the negative response to the IN AAAA
+// query for name, as cached from its SOA RR, or dns64MaxTTL if there is none.
+// The TTL of a synthesized AAAA RR must not exceed it (rfc6147/5.1.7).
+func (r *Resolver) negativeAAAATTL(name string) (ttl int32) {
+	ttl = dns64MaxTTL
+	for _, rec := range r.cached(name, func(rec *rr.RR) bool {
+		x, ok := rec.RData.(*rr.NODATA)
+		return ok && rec.Class == rr.CLASS_IN && x.Type == rr.TYPE_AAAA
+	}) {
+		ttl = rec.TTL
+	}
+	return
+}
+
+// ip6ArpaIP returns the IPv6 address of a full ip6.arpa name or nil.
+func ip6ArpaIP(name string) net.IP {
+	name = strings.ToLower(dns.RootedName(name))
+	const suffix = ".ip6.arpa."
+	if !strings.HasSuffix(name, suffix) {
+		return nil
+	}
+
+	nibbles := strings.Split(strings.TrimSuffix(name, suffix), ".")
+	if len(nibbles) != 2*net.IPv6len {
+		return nil
+	}
+
+	y := make(net.IP, net.IPv6len)
+	for i, s := range nibbles {
+		n, err := strconv.ParseUint(s, 16, 4)
+		if err != nil || len(s) != 1 {
+			return nil
+		}
+
+		k := net.IPv6len - 1 - i/2
+		if i%2 == 0 {
+			y[k] |= byte(n)
+		} else {
+			y[k] |= byte(n) << 4
+		}
+	}
+	return y
+}
+
+// lookupPTR64 performs an IN PTR lookup of sname with DNS64.
+func (r *Resolver) lookupPTR64(ctx context.Context, d *DNS64, sname string, rd bool) (answer, redirects rr.RRs, result LookupResult, err error) {
+	ip4 := d.Extract(ip6ArpaIP(sname))
+	if ip4 == nil {
+		return r.lookup(ctx, sname, msg.QTYPE_PTR, rr.CLASS_IN, rd)
+	}
+
+	target := dns.RevLookupName(ip4)
+	cname := &rr.RR{dns.RootedName(strings.ToLower(sname)), rr.TYPE_CNAME, rr.CLASS_IN, 0, &rr.CNAME{target}}
+	answer, redirects, result, err = r.lookup(ctx, target, msg.QTYPE_PTR, rr.CLASS_IN, rd)
+	redirects = append(rr.RRs{cname}, redirects...)
+	switch result {
+	case LookupOK:
+		result = LookupAliased
+	case LookupNameError:
+		result = LookupAliasError
+	}
+	return
+}
@@ -0,0 +1,29 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"errors"
+	"github.com/cznic/dns/doh"
+)
+
+var errDoHOff = errors.New("DNS over HTTPS is off")
+
+// SetDoH makes r send the queries for its upstream servers, i.e. the
+// forwarders and the SBELT nameservers of resolv.conf, to the DoH server of c
+// (rfc8484) instead. The upstream IPs then only select the statistics the
+// exchanges are accounted to. DoH takes precedence over DoT. A nil c turns
+// DoH off.
+func (r *Resolver) SetDoH(c *doh.Client) {
+	r.doh.Store(c)
+}
+
+// DoH returns the DoH client of r or nil if DoH is off.
+func (r *Resolver) DoH() *doh.Client {
+	c, _ := r.doh.Load().(*doh.Client)
+	return c
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/cznic/dns/dot"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// DoT configures DNS over TLS (rfc7858) of a Resolver. With DoT set, the
+// Resolver talks to its upstream servers, i.e. the forwarders and the SBELT
+// nameservers of resolv.conf, over TLS on port 853 instead of UDP and TCP on
+// port 53. The connection to every upstream is kept open and concurrent
+// queries are pipelined over it. Authoritative servers met while resolving
+// iteratively are still asked over UDP and TCP.
+type DoT struct {
+	// TLS configuration of the connections, may be nil. If its
+	// ServerName is empty, the certificate presented by an upstream must
+	// be valid for its IP address.
+	Config *tls.Config
+	// SPKI pins, see dot.Pin and dot.NewClient.
+	Pins [][]byte
+}
+
+var errDoTOff = errors.New("DNS over TLS is off")
+
+// dotState is a DoT with its clients.
+type dotState struct {
+	*DoT
+	clients map[string]*dot.Client
+	lock    sync.Mutex
+}
+
+// SetDoT sets the DNS over TLS configuration of r. A nil d turns DoT off.
+// Connections established under the previous configuration are closed. d
+// must not be modified after SetDoT.
+func (r *Resolver) SetDoT(d *DoT) {
+	var s *dotState
+	if d != nil {
+		s = &dotState{DoT: d, clients: map[string]*dot.Client{}}
+	}
+	if old, _ := r.dot.Swap(s).(*dotState); old != nil {
+		old.lock.Lock() // X++
+		for _, c := range old.clients {
+			c.Close()
+		}
+		old.lock.Unlock() // X--
+	}
+}
+
+// DoT returns the DNS over TLS configuration of r or nil if DoT is off.
+func (r *Resolver) DoT() *DoT {
+	if s, _ := r.dot.Load().(*dotState); s != nil {
+		return s.DoT
+	}
+
+	return nil
+}
+
+// dotClient returns the DoT client of ip or nil if DoT is off.
+func (r *Resolver) dotClient(ip net.IP) *dot.Client {
+	s, _ := r.dot.Load().(*dotState)
+	if s == nil {
+		return nil
+	}
+
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	k := ip.String()
+	c := s.clients[k]
+	if c == nil {
+		c = dot.NewClient(net.JoinHostPort(k, strconv.Itoa(dot.Port)), s.Config, s.Pins...)
+		s.clients[k] = c
+	}
+	return c
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"fmt"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/named"
+	"net"
+	"strings"
+)
+
+// Forwarding is a forwarding rule of a Resolver. It mirrors the Forward and
+// Forwarders settings of named.Options and named.Zone. Queries for Domain and
+// for names below Domain are sent with the RD flag set to Forwarders and their
+// answers are trusted. A rule for "." puts the Resolver into the forwarder
+// mode. When more rules apply to a name, the one with the longest Domain is
+// used. A rule with no Forwarders disables forwarding for its Domain, like
+// an empty forwarders statement of a named.conf zone does.
+type Forwarding struct {
+	Domain     string        // The forwarded domain.
+	Forward    named.Forward // named.ForwardFirst or named.ForwardOnly.
+	Forwarders []net.IP      // The upstream servers, asked in this order.
+}
+
+func (f *Forwarding) String() string {
+	return fmt.Sprintf("%s forward %s forwarders %v", f.Domain, f.Forward, f.Forwarders)
+}
+
+// NamedForwarding returns the forwarding rules defined by the Forward and
+// Forwarders settings of c, i.e. a "." rule for the global options and a rule
+// for every zone having its Forwarders set. A zone with non nil but empty
+// Forwarders, i.e. with an explicit "forwarders {};", gets a rule with no
+// Forwarders, which disables forwarding for the zone. Only forwarders
+// listening on the default port 53 are supported, an error is returned for
+// any other port.
+func NamedForwarding(c *named.Conf) (rules []Forwarding, err error) {
+	add := func(domain string, fwd named.Forward, ips named.IPs) (err error) {
+		rule := Forwarding{Domain: domain, Forward: fwd}
+		for _, x := range ips {
+			if x.Port != nil && *x.Port != 53 {
+				return fmt.Errorf("NamedForwarding %q: unsupported forwarder port %d", domain, *x.Port)
+			}
+
+			rule.Forwarders = append(rule.Forwarders, x.IP)
+		}
+		rules = append(rules, rule)
+		return
+	}
+
+	if o := c.Options; o != nil && len(o.Forwarders) != 0 {
+		if err = add(".", o.Forward, o.Forwarders); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, z := range c.Zones {
+		if z.Forwarders != nil {
+			if err = add(z.Name, z.Forward, z.Forwarders); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return
+}
+
+// SetForwarding replaces the forwarding rules of r. Calling SetForwarding with
+// no rules turns forwarding off, r then resolves all names iteratively.
+func (r *Resolver) SetForwarding(rules ...Forwarding) {
+	t := dns.NewTree()
+	for i := range rules {
+		rule := rules[i]
+		rule.Domain = dns.RootedName(strings.ToLower(rule.Domain))
+		t.Put(rule.Domain, &rule)
+	}
+	r.forwarding.Store(t)
+}
+
+// Forwarding returns the forwarding rules of r.
+func (r *Resolver) Forwarding() (rules []Forwarding) {
+	t, _ := r.forwarding.Load().(*dns.Tree)
+	if t == nil {
+		return
+	}
+
+	t.Enum("", func(path []string, data interface{}) bool {
+		rules = append(rules, *data.(*Forwarding))
+		return true
+	})
+	return
+}
+
+// forwardingFor returns the forwarding rule applying to name or nil if name
+// is to be resolved iteratively.
+func (r *Resolver) forwardingFor(name string) *Forwarding {
+	t, _ := r.forwarding.Load().(*dns.Tree)
+	if t == nil {
+		return nil
+	}
+
+	if rule, _ := t.Match(name).(*Forwarding); rule != nil && len(rule.Forwarders) != 0 {
+		return rule
+	}
+
+	return nil
+}
+
+// forwarders returns the SLIST of the rule forwarders.
+func (r *Resolver) forwarders(rule *Forwarding) (s *srvlist) {
+	s = &srvlist{conf: r.getQueryConf(), ordered: true}
+	for i, ip := range rule.Forwarders {
+		n := fmt.Sprintf("%d.FORWARDER.%s", i, rule.Domain)
+		s.servers = append(s.servers, server{zone: rule.Domain, name: n, attempts: int(s.conf.Conf.Opt.Attempts), ips: []net.IP{ip}, matchcount: -1})
+	}
+	return
+}
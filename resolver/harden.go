@@ -0,0 +1,242 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"net"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	optCookie       = 10 // rfc7873/4 COOKIE option code
+	clientCookieLen = 8  // rfc7873/4
+	minServerCookie = 8  // rfc7873/4
+	maxServerCookie = 32 // rfc7873/4
+	rcodeBADCOOKIE  = 23 // rfc7873/8
+)
+
+// SetCaseRandomisation turns on or off the 0x20 encoding of QNAMEs sent to
+// nameservers (draft-vixie-dnsext-dns0x20). With 0x20 on, the letters of a
+// QNAME are sent in a random mix of cases and a reply is accepted only if its
+// question section repeats the QNAME exactly, adding unpredictable bits to
+// the message ID and source port an off-path attacker must guess.
+func (r *Resolver) SetCaseRandomisation(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&r.x20, v)
+}
+
+// CaseRandomisation returns whether the 0x20 encoding of QNAMEs is on.
+func (r *Resolver) CaseRandomisation() bool {
+	return atomic.LoadInt32(&r.x20) != 0
+}
+
+// SetCookies turns on or off DNS cookies (rfc7873) in EDNS queries sent to
+// nameservers. With cookies on, every query carries a client cookie derived
+// from a per Resolver secret and the server IP, together with the last
+// server cookie received from that IP. Replies echoing a different client
+// cookie are rejected, a BADCOOKIE reply is retried with the fresh server
+// cookie it carries and, if that fails again, over TCP.
+func (r *Resolver) SetCookies(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&r.cookies, v)
+}
+
+// Cookies returns whether DNS cookies are on.
+func (r *Resolver) Cookies() bool {
+	return atomic.LoadInt32(&r.cookies) != 0
+}
+
+// randomCase returns name with the case of its letters randomized.
+func randomCase(name string) string {
+	bits := make([]byte, len(name)/8+1)
+	if _, err := rand.Read(bits); err != nil {
+		return name
+	}
+
+	b := []byte(name)
+	for i, c := range b {
+		if bits[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+
+		switch {
+		case c >= 'a' && c <= 'z':
+			b[i] = c - 'a' + 'A'
+		case c >= 'A' && c <= 'Z':
+			b[i] = c - 'A' + 'a'
+		}
+	}
+	return string(b)
+}
+
+// checkQuestion returns an error if the question section of reply is not the
+// question of query. Names are compared case sensitively if exact is true.
+func checkQuestion(query, reply *msg.Message, exact bool) (err error) {
+	if len(reply.Question) != len(query.Question) {
+		return fmt.Errorf("rejected reply, question mismatch: %s", reply.Question)
+	}
+
+	for i, q := range query.Question {
+		x := reply.Question[i]
+		if x.QTYPE != q.QTYPE || x.QCLASS != q.QCLASS {
+			return fmt.Errorf("rejected reply, question mismatch: %s", reply.Question)
+		}
+
+		switch {
+		case x.QNAME == q.QNAME:
+			// ok
+		case exact:
+			return fmt.Errorf("rejected reply, 0x20 QNAME mismatch: %q != %q", x.QNAME, q.QNAME)
+		case !strings.EqualFold(x.QNAME, q.QNAME):
+			return fmt.Errorf("rejected reply, question mismatch: %s", reply.Question)
+		}
+	}
+	return
+}
+
+// uncase restores the case of the names of reply which were sent 0x20
+// encoded in query. Servers compress the names of the records, including the
+// names in their RDATA, against the QNAME, so any name ending with the QNAME
+// may repeat its case. Such suffixes are rewritten to the QNAME as it was
+// before the encoding, i.e. in lower case. reply must not be yet shared.
+func uncase(query, reply *msg.Message) {
+	for i, q := range query.Question {
+		name := strings.ToLower(q.QNAME)
+		reply.Question[i].QNAME = name
+		fix := func(s *string) {
+			if n := len(*s) - len(name); n >= 0 && strings.EqualFold((*s)[n:], name) && (n == 0 || (*s)[n-1] == '.') {
+				*s = (*s)[:n] + name
+			}
+		}
+		for _, part := range []rr.RRs{reply.Answer, reply.Authority, reply.Additional} {
+			for _, rec := range part {
+				fix(&rec.Name)
+				for _, p := range rdataNames(rec) {
+					fix(p)
+				}
+			}
+		}
+	}
+}
+
+// rdataNames returns the domain names in the RDATA of rec, for the types
+// whose RDATA names may be compressed (rfc3597/4) and a few more commonly
+// compressed by servers.
+func rdataNames(rec *rr.RR) []*string {
+	switch x := rec.RData.(type) {
+	case *rr.AFSDB:
+		return []*string{&x.Hostname}
+	case *rr.CNAME:
+		return []*string{&x.Name}
+	case *rr.DNAME:
+		return []*string{&x.Name}
+	case *rr.KX:
+		return []*string{&x.Exchanger}
+	case *rr.MB:
+		return []*string{&x.MADNAME}
+	case *rr.MG:
+		return []*string{&x.MGNAME}
+	case *rr.MINFO:
+		return []*string{&x.RMAILBX, &x.EMAILBX}
+	case *rr.MR:
+		return []*string{&x.NEWNAME}
+	case *rr.MX:
+		return []*string{&x.Exchange}
+	case *rr.NS:
+		return []*string{&x.NSDName}
+	case *rr.PTR:
+		return []*string{&x.PTRDName}
+	case *rr.RT:
+		return []*string{&x.Hostname}
+	case *rr.SOA:
+		return []*string{&x.MName, &x.RName}
+	case *rr.SRV:
+		return []*string{&x.Target}
+	}
+	return nil
+}
+
+// clientCookie returns the client cookie used with ip (rfc7873/A.2).
+func (r *Resolver) clientCookie(ip net.IP) []byte {
+	r.cookieOnce.Do(func() {
+		if _, err := rand.Read(r.cookieSecret[:]); err != nil {
+			panic(err)
+		}
+	})
+
+	h := hmac.New(sha256.New, r.cookieSecret[:])
+	h.Write(ip.To16())
+	return h.Sum(nil)[:clientCookieLen]
+}
+
+// cookieOPT returns an OPT RR advertising the UDP payload size with the
+// COOKIE option for ip.
+func (r *Resolver) cookieOPT(ip net.IP, size uint16) *rr.RR {
+	data := append(r.clientCookie(ip), r.stats.serverCookie(ip)...)
+	return &rr.RR{".", rr.TYPE_OPT, rr.Class(size), optRR.TTL, &rr.OPT{[]rr.OPT_DATA{{optCookie, data}}}}
+}
+
+// cookie returns the data of the COOKIE option of m, if any.
+func cookie(m *msg.Message) (data []byte, ok bool) {
+	if x := opt(m); x != nil {
+		for _, v := range x.RData.(*rr.OPT).Values {
+			if v.Code == optCookie {
+				return v.Data, true
+			}
+		}
+	}
+	return
+}
+
+// extRCODE returns the extended RCODE of m (rfc6891/6.1.3).
+func extRCODE(m *msg.Message) int {
+	rcode := int(m.RCODE)
+	if x := opt(m); x != nil {
+		var ext rr.EXT_RCODE
+		ext.FromTTL(x.TTL)
+		rcode |= int(ext.RCODE) << 4
+	}
+	return rcode
+}
+
+// checkCookie verifies the COOKIE option of a reply from ip to query and
+// remembers the server cookie it carries (rfc7873/5.3). A reply without a
+// COOKIE option is accepted.
+func (r *Resolver) checkCookie(query, reply *msg.Message, ip net.IP) (err error) {
+	sent, ok := cookie(query)
+	if !ok {
+		return
+	}
+
+	got, ok := cookie(reply)
+	if !ok {
+		return
+	}
+
+	if len(got) < clientCookieLen || !bytes.Equal(got[:clientCookieLen], sent[:clientCookieLen]) {
+		return fmt.Errorf("rejected reply, client cookie mismatch")
+	}
+
+	if n := len(got) - clientCookieLen; n >= minServerCookie && n <= maxServerCookie {
+		r.stats.setServerCookie(ip, got[clientCookieLen:])
+	}
+	return
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"context"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"net"
+	"strings"
+)
+
+// NetLookuper is the subset of the net.Resolver methods implemented by
+// NetResolver. Both *net.Resolver and *NetResolver satisfy it.
+type NetLookuper interface {
+	LookupAddr(ctx context.Context, addr string) (names []string, err error)
+	LookupCNAME(ctx context.Context, host string) (cname string, err error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error)
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+var _ NetLookuper = (*net.Resolver)(nil)
+var _ NetLookuper = (*NetResolver)(nil)
+
+// NetResolver adapts a Resolver to the net.Resolver API. Host names are
+// resolved using the hosts file first and the search list of resolv.conf,
+// like Resolver.GetHostByName does. Errors are reported as *net.DNSError.
+type NetResolver struct {
+	r *Resolver
+}
+
+// NewNetResolver returns a NetResolver using r.
+func NewNetResolver(r *Resolver) *NetResolver {
+	return &NetResolver{r}
+}
+
+// dnsError returns a *net.DNSError describing a failed lookup of name. A
+// successful result means no records of the wanted type were found.
+func dnsError(ctx context.Context, name string, result LookupResult, err error) error {
+	e := &net.DNSError{Name: name}
+	switch {
+	case ctx.Err() != nil:
+		e.Err = ctx.Err().Error()
+		e.IsTimeout = ctx.Err() == context.DeadlineExceeded
+	case err != nil:
+		e.Err = err.Error()
+		e.IsTemporary = true
+	case result == LookupFail:
+		e.Err = "server misbehaving"
+		e.IsTemporary = true
+	case result == LookupNameError, result == LookupDataNotFound, result == LookupAliasError,
+		result == LookupOK, result == LookupAliased:
+		e.Err = "no such host"
+		e.IsNotFound = true
+	default:
+		e.Err = LookupResultStr[result]
+	}
+	return e
+}
+
+// lookupIP returns the IPv4 and IPv6 addresses of host.
+func (n *NetResolver) lookupIP(ctx context.Context, host string) (ips []net.IP, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	qc := n.r.getQueryConf()
+	qlist := qc.hostqlist(strings.ToLower(strings.TrimSpace(host)))
+	for _, q := range qlist {
+		if ips, _ = qc.qhosts(q); ips != nil { // resolved from "hosts"
+			return
+		}
+	}
+
+	qtypes := []msg.QType{msg.QTYPE_A, msg.QTYPE_AAAA}
+	if qc.Conf.Opt.Inet6 {
+		qtypes[0], qtypes[1] = qtypes[1], qtypes[0]
+	}
+	failed := false
+	for _, qtype := range qtypes {
+	qlist:
+		for _, q := range qlist {
+			rrs, _, result, err := n.r.LookupContext(ctx, q, qtype, rr.CLASS_IN, false)
+			if err != nil {
+				return nil, dnsError(ctx, host, result, err)
+			}
+
+			switch result {
+			case LookupOK, LookupAliased:
+				for _, rec := range rrs {
+					switch x := rec.RData.(type) {
+					case *rr.A:
+						ips = append(ips, x.Address)
+					case *rr.AAAA:
+						ips = append(ips, x.Address)
+					}
+				}
+				break qlist
+			case LookupFail:
+				failed = true
+			}
+		}
+	}
+	if len(ips) != 0 {
+		sortIPs(qc.Conf.Sortlist, ips)
+		return
+	}
+
+	if failed {
+		return nil, dnsError(ctx, host, LookupFail, nil)
+	}
+
+	return nil, dnsError(ctx, host, LookupNameError, nil)
+}
+
+// LookupHost looks up host, returning a slice of its addresses.
+func (n *NetResolver) LookupHost(ctx context.Context, host string) (addrs []string, err error) {
+	var ips []net.IP
+	if ips, err = n.lookupIP(ctx, host); err != nil {
+		return
+	}
+
+	for _, ip := range ips {
+		addrs = append(addrs, ip.String())
+	}
+	return
+}
+
+// LookupIPAddr looks up host, returning its IPv4 and IPv6 addresses.
+func (n *NetResolver) LookupIPAddr(ctx context.Context, host string) (addrs []net.IPAddr, err error) {
+	var ips []net.IP
+	if ips, err = n.lookupIP(ctx, host); err != nil {
+		return
+	}
+
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: ip})
+	}
+	return
+}
+
+// LookupCNAME returns the canonical name of host, i.e. the end of its CNAME
+// chain or host itself if it is not an alias. The first name of the search
+// list of host which exists is used.
+func (n *NetResolver) LookupCNAME(ctx context.Context, host string) (cname string, err error) {
+	failed := false
+	for _, q := range n.r.getQueryConf().hostqlist(strings.ToLower(strings.TrimSpace(host))) {
+		_, redirects, result, err := n.r.LookupContext(ctx, q, msg.QTYPE_A, rr.CLASS_IN, false)
+		if err != nil {
+			return "", dnsError(ctx, host, result, err)
+		}
+
+		switch result {
+		case LookupOK, LookupAliased, LookupDataNotFound:
+			if len(redirects) != 0 {
+				return dns.RootedName(redirects[len(redirects)-1].RData.(*rr.CNAME).Name), nil
+			}
+
+			return dns.RootedName(q), nil
+		case LookupFail:
+			failed = true
+		}
+	}
+
+	if failed {
+		return "", dnsError(ctx, host, LookupFail, nil)
+	}
+
+	return "", dnsError(ctx, host, LookupNameError, nil)
+}
+
+// LookupAddr performs a reverse lookup for addr, returning a list of names
+// mapping to it.
+func (n *NetResolver) LookupAddr(ctx context.Context, addr string) (names []string, err error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, &net.DNSError{Err: "unrecognized address", Name: addr}
+	}
+
+	hosts, result, err := n.r.hostsByAddr(ctx, ip)
+	if err != nil || len(hosts) == 0 {
+		return nil, dnsError(ctx, addr, result, err)
+	}
+
+	for _, h := range hosts {
+		names = append(names, dns.RootedName(h))
+	}
+	return
+}
+
+// LookupMX returns the MX RRs of name sorted by preference.
+func (n *NetResolver) LookupMX(ctx context.Context, name string) (mx []*net.MX, err error) {
+	x, result, err := n.r.LookupMXContext(ctx, dns.RootedName(name))
+	if err != nil || len(x) == 0 {
+		return nil, dnsError(ctx, name, result, err)
+	}
+
+	for _, v := range x {
+		mx = append(mx, &net.MX{Host: dns.RootedName(v.Exchange), Pref: v.Preference})
+	}
+	return
+}
+
+// LookupSRV looks up the SRV RRs of _service._proto.name, or of name if both
+// service and proto are empty. The returned RRs are ordered by priority and
+// weight (rfc2782).
+func (n *NetResolver) LookupSRV(ctx context.Context, service, proto, name string) (cname string, addrs []*net.SRV, err error) {
+	cname, x, result, err := n.r.LookupSRVContext(ctx, service, proto, dns.RootedName(name))
+	if err != nil || len(x) == 0 {
+		return "", nil, dnsError(ctx, name, result, err)
+	}
+
+	for _, v := range x {
+		addrs = append(addrs, &net.SRV{Target: dns.RootedName(v.Target), Port: v.Port, Priority: v.Priority, Weight: v.Weight})
+	}
+	return dns.RootedName(cname), addrs, nil
+}
+
+// LookupTXT returns the TXT RRs of name, the character strings of every RR
+// concatenated.
+func (n *NetResolver) LookupTXT(ctx context.Context, name string) (txt []string, err error) {
+	txt, result, err := n.r.LookupTXTContext(ctx, dns.RootedName(name))
+	if err != nil || len(txt) == 0 {
+		return nil, dnsError(ctx, name, result, err)
+	}
+
+	return
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"strings"
+	"sync/atomic"
+)
+
+// QNameMinimisation is the QNAME minimisation mode of a Resolver (rfc9156).
+// With QNAME minimisation on, a server is asked only for the next label below
+// the zone it is known to be authoritative for, using QTYPE A, until the zone
+// cut of the full QNAME is reached. Queries with the RD flag and queries sent
+// to the SBELT are never minimised.
+type QNameMinimisation int32
+
+// Values of QNameMinimisation.
+const (
+	QNameMinOff     QNameMinimisation = iota // Full QNAMEs are sent to all servers (default).
+	QNameMinRelaxed                          // Fall back to the full QNAME on NXDOMAIN or error responses to minimised queries.
+	QNameMinStrict                           // NXDOMAIN for a minimised QNAME ends the lookup (rfc8020).
+)
+
+const (
+	maxMinimiseCount = 10 // rfc9156/2.3 MAX_MINIMISE_COUNT
+	minimiseOneLab   = 4  // rfc9156/2.3 MINIMISE_ONE_LAB
+)
+
+// SetQNameMinimisation sets the QNAME minimisation mode of r.
+func (r *Resolver) SetQNameMinimisation(mode QNameMinimisation) {
+	atomic.StoreInt32(&r.qnameMin, int32(mode))
+}
+
+// QNameMinimisation returns the QNAME minimisation mode of r.
+func (r *Resolver) QNameMinimisation() QNameMinimisation {
+	return QNameMinimisation(atomic.LoadInt32(&r.qnameMin))
+}
+
+// minimisedLabels returns the number of labels of the next minimised query
+// when have labels are known to exist, the full QNAME has total labels and
+// count minimised queries were already sent.
+func minimisedLabels(have, total, count int) (n int) {
+	switch {
+	case count < minimiseOneLab:
+		n = have + 1
+	case count >= maxMinimiseCount:
+		n = total
+	default:
+		step := (total - have) / (maxMinimiseCount - count)
+		if step < 1 {
+			step = 1
+		}
+		n = have + step
+	}
+	if n > total {
+		n = total
+	}
+	return
+}
+
+// minimisedName returns the rooted name formed by the last n labels of
+// labels.
+func minimisedName(labels []string, n int) string {
+	return dns.RootedName(strings.Join(labels[len(labels)-n:], "."))
+}
+
+// isReferral returns whether reply to a query for qname is a referral to a
+// zone below the zone having zoneLabels labels.
+func isReferral(reply *msg.Message, qname string, sclass rr.Class, zoneLabels int) (y bool) {
+	if reply.RCODE != msg.RC_NO_ERROR || reply.AA || len(reply.Answer) != 0 {
+		return
+	}
+
+	for _, rec := range reply.Authority {
+		switch rec.Type {
+		case rr.TYPE_SOA:
+			return false
+		case rr.TYPE_NS:
+			if rec.Class != sclass {
+				continue
+			}
+
+			if mc, err := dns.MatchCount(qname, rec.Name); err == nil && mc > zoneLabels {
+				if labels, err := dns.Labels(rec.Name); err == nil && len(labels) == mc {
+					y = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// hasCNAME returns whether the answer section of reply has a CNAME owned by
+// name.
+func hasCNAME(reply *msg.Message, name string) bool {
+	for _, rec := range reply.Answer {
+		if rec.Type == rr.TYPE_CNAME && strings.ToLower(dns.RootedName(rec.Name)) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -8,20 +8,25 @@
 package resolver
 
 import (
+	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/cznic/dns"
 	"github.com/cznic/dns/cache"
 	"github.com/cznic/dns/hosts"
 	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/named"
 	"github.com/cznic/dns/resolv"
 	"github.com/cznic/dns/rr"
+	"github.com/cznic/dns/transport"
 	"log"
 	"net"
 	"os"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -100,13 +105,86 @@ func (q *queryConf) hostqlist(name string) (list []string) {
 	return
 }
 
-type goStrMapBool struct {
-	m    map[string]bool
+// flight is an in-flight or held flights.do invocation.
+type flight struct {
+	done    chan struct{}      // closed when v and err are valid
+	cancel  context.CancelFunc // cancels the ctx of the invocation
+	waiters int                // callers waiting for the result, guarded by flights.lock
+	v       interface{}
+	err     error
+}
+
+// flights coalesce concurrent invocations of identical operations, e.g.
+// exchanges of the same question with the same server.
+type flights struct {
+	m    map[string]*flight
 	lock sync.Mutex
 }
 
-func newGoStrMapBool() *goStrMapBool {
-	return &goStrMapBool{m: map[string]bool{}}
+func newFlights() *flights {
+	return &flights{m: map[string]*flight{}}
+}
+
+// do invokes fn unless an invocation for key is already in flight or held, in
+// which case do waits for its result instead; shared reports that case. fn
+// runs in its own goroutine and every caller, including the one invoking fn,
+// waits for the result bounded by its own ctx only. The ctx passed to fn
+// carries the values of the ctx of the invoking caller, but it is canceled
+// only when all the callers waiting for the result have given up. Successful
+// results are held for hold, i.e. during that time further invocations for
+// key share the result without invoking fn.
+func (f *flights) do(ctx context.Context, key string, hold time.Duration, fn func(ctx context.Context) (interface{}, error)) (v interface{}, err error, shared bool) {
+	f.lock.Lock() // X++
+	c, shared := f.m[key]
+	if !shared {
+		fctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		c = &flight{done: make(chan struct{}), cancel: cancel}
+		f.m[key] = c
+		go func() {
+			c.v, c.err = fn(fctx)
+			cancel()
+			forget := func() {
+				f.lock.Lock() // X++
+				f.forget(key, c)
+				f.lock.Unlock() // X--
+			}
+			switch {
+			case hold > 0 && c.err == nil:
+				time.AfterFunc(hold, forget)
+			default:
+				forget()
+			}
+			close(c.done)
+		}()
+	}
+	c.waiters++
+	f.lock.Unlock() // X--
+
+	select {
+	case <-c.done:
+		return c.v, c.err, shared
+	case <-ctx.Done():
+		f.lock.Lock() // X++
+		if c.waiters--; c.waiters == 0 {
+			select {
+			case <-c.done:
+				// held
+			default:
+				c.cancel()
+				f.forget(key, c)
+			}
+		}
+		f.lock.Unlock() // X--
+		return nil, ctx.Err(), shared
+	}
+}
+
+// forget removes c from f unless key already refers to another flight. f
+// must be locked.
+func (f *flights) forget(key string, c *flight) {
+	if f.m[key] == c {
+		delete(f.m, key) // P--
+	}
 }
 
 // LookupResult is the type of the Resolver.Lookup() result.
@@ -121,6 +199,7 @@ const (
 	LookupFail                             // E.g. can't contact any DNS server (wrong conf or network communication error)
 	LookupAliasLoop                        // Detected a cycle in the aliases chain
 	LookupAliasError                       // QNAME is an alias to a non existing canonical name
+	LookupYXDomain                         // A DNAME substitution of QNAME would be longer than the maximum name length
 )
 
 var LookupResultStr = map[LookupResult]string{
@@ -131,15 +210,29 @@ var LookupResultStr = map[LookupResult]string{
 	LookupFail:         "Lookup fail. Could be also wrong resolver configuration or network communication error.",
 	LookupAliasLoop:    "Detected a cycle in the aliases chain",
 	LookupAliasError:   "QNAME is an alias to a non existing canonical name",
+	LookupYXDomain:     "DNAME substitution of QNAME would be longer than the maximum name length",
 }
 
 // Resolver is a DNS resolver.
 type Resolver struct {
-	cache                 *cache.Cache
-	hostName              string
-	log                   *dns.Logger
-	getQueryConf          func() *queryConf
-	pendingA, pendingAAAA *goStrMapBool // paralel NS addr requests recursion protector
+	cache        *cache.Cache
+	hostName     string
+	log          *dns.Logger
+	getQueryConf func() *queryConf
+	flights      *flights        // coalesced exchanges and NS addr requests
+	stats        *serverStats    // per nameserver IP statistics
+	rotate       uint32          // SBELT rotation counter
+	qnameMin     int32           // QNameMinimisation, accessed atomically
+	forwarding   atomic.Value    // *dns.Tree of *Forwarding
+	dot          atomic.Value    // *dotState
+	doh          atomic.Value    // *doh.Client
+	transport    atomic.Value    // *transport.Factory
+	tcp          *transport.Pool // pipelined TCP connections, may be nil
+	dns64        atomic.Value    // *DNS64
+	x20          int32           // 0x20 QNAME encoding, accessed atomically
+	cookies      int32           // rfc7873 DNS cookies, accessed atomically
+	cookieOnce   sync.Once
+	cookieSecret [16]byte // client cookie secret
 }
 
 // New returns a new Resolver or an error if any.
@@ -155,7 +248,7 @@ func New(hostsFName, resolvFName string, logger *dns.Logger) (r *Resolver, err e
 	if logger == nil {
 		logger = dns.NoLogger
 	}
-	r = &Resolver{cache: cache.New(), log: logger, pendingA: newGoStrMapBool(), pendingAAAA: newGoStrMapBool()}
+	r = &Resolver{cache: cache.New(), log: logger, flights: newFlights(), stats: newServerStats(), tcp: &transport.Pool{}}
 
 	defer func() {
 		if e := recover(); e != nil {
@@ -236,7 +329,7 @@ func (r *Resolver) Logger() *dns.Logger {
 	return r.log
 }
 
-func (r *Resolver) getHostByName(name string, qtype msg.QType) (ipList []net.IP, redirects rr.RRs, err error) {
+func (r *Resolver) getHostByName(ctx context.Context, name string, qtype msg.QType) (ipList []net.IP, redirects rr.RRs, err error) {
 	qc := r.getQueryConf()
 	// query trylist
 	qlist := qc.hostqlist(strings.ToLower(strings.TrimSpace(name)))
@@ -248,7 +341,7 @@ func (r *Resolver) getHostByName(name string, qtype msg.QType) (ipList []net.IP,
 	}
 
 	for i, q := range qlist {
-		rrs, cnames, result, e := r.Lookup(q, qtype, rr.CLASS_IN, false)
+		rrs, cnames, result, e := r.LookupContext(ctx, q, qtype, rr.CLASS_IN, false)
 		if e != nil {
 			err = e
 			return
@@ -276,6 +369,7 @@ func (r *Resolver) getHostByName(name string, qtype msg.QType) (ipList []net.IP,
 					ipList = append(ipList, x.Address)
 				}
 			}
+			sortIPs(qc.Conf.Sortlist, ipList)
 			return
 		}
 		panic("unreachable")
@@ -287,36 +381,71 @@ func (r *Resolver) getHostByName(name string, qtype msg.QType) (ipList []net.IP,
 // GetHostByNameIPv4 will try to Lookup an IN A address (i.e. IPv4) list for
 // name.  Used CNAMEs chain, if any, is returned in redirects.
 func (r *Resolver) GetHostByNameIPv4(name string) (ipList []net.IP, redirects rr.RRs, err error) {
-	return r.getHostByName(name, msg.QTYPE_A)
+	return r.GetHostByNameIPv4Context(context.Background(), name)
+}
+
+// GetHostByNameIPv4Context is like GetHostByNameIPv4 but the whole resolution
+// is bounded by ctx. See LookupContext for details.
+func (r *Resolver) GetHostByNameIPv4Context(ctx context.Context, name string) (ipList []net.IP, redirects rr.RRs, err error) {
+	return r.getHostByName(ctx, name, msg.QTYPE_A)
 }
 
 // GetHostByNameIPv6 will try to Lookup an IN AAAA address (i.e. IPv6) list for
 // name.  Used CNAMEs chain, if any, is returned in redirects.
 func (r *Resolver) GetHostByNameIPv6(name string) (ipList []net.IP, redirects rr.RRs, err error) {
-	return r.getHostByName(name, msg.QTYPE_AAAA)
+	return r.GetHostByNameIPv6Context(context.Background(), name)
+}
+
+// GetHostByNameIPv6Context is like GetHostByNameIPv6 but the whole resolution
+// is bounded by ctx. See LookupContext for details.
+func (r *Resolver) GetHostByNameIPv6Context(ctx context.Context, name string) (ipList []net.IP, redirects rr.RRs, err error) {
+	return r.getHostByName(ctx, name, msg.QTYPE_AAAA)
 }
 
 // GetHostByName will try to Lookup an IN A or AAAA address (i.e. IPv4 or IPv6)
 // list for name.  Used CNAMEs chain, if any, is returned in redirects.
 // Initially an attempt for IPv4 addresses is performed. Query for the IPv6
 // addresses is afterwards invoked iff no IPv4 addresses were returned by the
-// initial attempt. If preferIPv6 == true then the above query order is
-// reversed.
+// initial attempt. If preferIPv6 == true or the resolv.conf inet6 option is
+// set then the above query order is reversed. Addresses obtained from DNS are
+// ordered according to the resolv.conf sortlist, if any.
 func (r *Resolver) GetHostByName(name string, preferIPv6 bool) (ipList []net.IP, redirects rr.RRs, err error) {
-	a, b := (*Resolver).GetHostByNameIPv4, (*Resolver).GetHostByNameIPv6
-	if preferIPv6 {
+	return r.GetHostByNameContext(context.Background(), name, preferIPv6)
+}
+
+// GetHostByNameContext is like GetHostByName but the whole resolution is
+// bounded by ctx. See LookupContext for details.
+func (r *Resolver) GetHostByNameContext(ctx context.Context, name string, preferIPv6 bool) (ipList []net.IP, redirects rr.RRs, err error) {
+	a, b := (*Resolver).GetHostByNameIPv4Context, (*Resolver).GetHostByNameIPv6Context
+	if preferIPv6 || r.getQueryConf().Conf.Opt.Inet6 {
 		a, b = b, a
 	}
 
-	if ipList, redirects, err = a(r, name); len(ipList) != 0 {
+	if ipList, redirects, err = a(r, ctx, name); len(ipList) != 0 || ctx.Err() != nil {
 		return
 	}
 
-	return b(r, name)
+	return b(r, ctx, name)
 }
 
 // GetHostByAddr will try to resolve an IPv4 or IPv6 address to host name(s).
 func (r *Resolver) GetHostByAddr(ip net.IP) (hosts []string, err error) {
+	return r.GetHostByAddrContext(context.Background(), ip)
+}
+
+// GetHostByAddrContext is like GetHostByAddr but the whole resolution is
+// bounded by ctx. See LookupContext for details.
+func (r *Resolver) GetHostByAddrContext(ctx context.Context, ip net.IP) (hosts []string, err error) {
+	var rslt LookupResult
+	if hosts, rslt, err = r.hostsByAddr(ctx, ip); err == nil && hosts == nil {
+		err = fmt.Errorf("GetHostByAddr: %s", LookupResultStr[rslt])
+	}
+	return
+}
+
+// hostsByAddr implements GetHostByAddrContext. The result of the PTR lookup,
+// if any, is returned in rslt, hosts are nil if it was not successful.
+func (r *Resolver) hostsByAddr(ctx context.Context, ip net.IP) (hosts []string, rslt LookupResult, err error) {
 	qc := r.getQueryConf()
 	if hosts, _ = qc.qips(ip); hosts != nil {
 		return // resolved from hosts
@@ -324,18 +453,15 @@ func (r *Resolver) GetHostByAddr(ip net.IP) (hosts []string, err error) {
 
 	name := dns.RevLookupName(ip)
 	if name == "" {
-		return nil, fmt.Errorf("GetHostByAddr:invalid ip '% x'", ip)
+		return nil, LookupFail, fmt.Errorf("GetHostByAddr:invalid ip '% x'", ip)
 	}
 
 	var rrs rr.RRs
-	var rslt LookupResult
-	if rrs, _, rslt, err = r.Lookup(name, msg.QTYPE_PTR, rr.CLASS_IN, false); err != nil {
+	if rrs, _, rslt, err = r.LookupContext(ctx, name, msg.QTYPE_PTR, rr.CLASS_IN, false); err != nil {
 		return
 	}
 
 	switch rslt {
-	default:
-		err = fmt.Errorf("GetHostByAddr: %s", LookupResultStr[rslt])
 	case LookupOK, LookupAliased:
 		for _, v := range rrs {
 			hosts = append(hosts, v.RData.(*rr.PTR).PTRDName)
@@ -344,8 +470,11 @@ func (r *Resolver) GetHostByAddr(ip net.IP) (hosts []string, err error) {
 	return
 }
 
+// sbelt returns the SBELT, i.e. the resolv.conf nameservers. The servers are
+// listed in the file order or, with the rotate option, starting with the next
+// one on every invocation.
 func (r *Resolver) sbelt() (s *srvlist) {
-	s = &srvlist{conf: r.getQueryConf()}
+	s = &srvlist{conf: r.getQueryConf(), ordered: true}
 	servers := s.conf.Conf.Nameserver
 	if len(servers) == 0 {
 		s.servers = []server{{zone: "DefaultLocalNameServer.", name: "DefaultLocalNameServer.", attempts: int(s.conf.Conf.Opt.Attempts), ips: []net.IP{dns.DefaultLocalNameServer()}, matchcount: -1}}
@@ -357,6 +486,10 @@ func (r *Resolver) sbelt() (s *srvlist) {
 		n := fmt.Sprintf("%d.SBELT.", i)
 		s.servers[i] = server{zone: n, name: n, attempts: int(s.conf.Conf.Opt.Attempts), ips: []net.IP{srv}, matchcount: -1}
 	}
+	if s.conf.Conf.Opt.Rotate {
+		k := int(atomic.AddUint32(&r.rotate, 1)-1) % len(servers)
+		s.servers = append(s.servers[k:], s.servers[:k]...)
+	}
 	return
 }
 
@@ -367,31 +500,277 @@ func (r *Resolver) cached(name string, want func(*rr.RR) bool) (wanted rr.RRs) {
 	return
 }
 
-func (r *Resolver) needNSAdr(name string) {
+// cacheable returns whether answers to stype queries may be cached according
+// to the cache Policy, if any.
+func (r *Resolver) cacheable(stype msg.QType) bool {
+	p := r.cache.Policy()
+	return p == nil || p.Cacheable(rr.Type(stype))
+}
+
+func (r *Resolver) needNSAdr(ctx context.Context, name string) {
 	const retry = 60e9 // Don't retry for a minute
 
-	f := func(p *goStrMapBool, q msg.QType) {
-		p.lock.Lock()         // X++
-		defer p.lock.Unlock() // X--
-		if p.m[name] {        // P
-			return
+	f := func(q msg.QType) {
+		r.flights.do(ctx, fmt.Sprintf("%s\x00%s", q, name), retry, func(ctx context.Context) (interface{}, error) {
+			_, _, _, err := r.lookup(ctx, name, q, rr.CLASS_IN, true) //TODO Param? Support anything outside CLASS_IN?
+			return nil, err                                           // An error means the lookup was not completed, allow a retry.
+		})
+	}
+
+	go f(msg.QTYPE_A)
+	go f(msg.QTYPE_AAAA)
+}
+
+var optRR = &rr.RR{".", rr.TYPE_OPT, rr.Class(ednsBufSize), (&rr.EXT_RCODE{}).ToTTL(), &rr.OPT{}}
+
+// newQuery returns a query message for sname, stype, sclass with the RD flag
+// set to rd. If edns is true then an OPT RR is included.
+func newQuery(sname string, stype msg.QType, sclass rr.Class, rd, edns bool) (m *msg.Message) {
+	m = msg.New()
+	m.Question.Append(sname, stype, sclass)
+	if edns {
+		m.Additional = rr.RRs{optRR}
+	}
+	m.Header.RD = rd // Recursion Desired
+	return
+}
+
+// question returns newQuery(sname, stype, sclass, rd, size != 0) for ip,
+// with the QNAME 0x20 encoded if that is turned on. A non zero size is the
+// UDP payload size advertised in the OPT RR, which carries the DNS cookies if
+// those are turned on.
+func (r *Resolver) question(sname string, stype msg.QType, sclass rr.Class, rd bool, size uint16, ip net.IP) (m *msg.Message) {
+	if r.CaseRandomisation() {
+		sname = randomCase(sname)
+	}
+	m = newQuery(sname, stype, sclass, rd, size != 0)
+	switch {
+	case size == 0:
+		// nop
+	case r.Cookies():
+		m.Additional = rr.RRs{r.cookieOPT(ip, size)}
+	case size != ednsBufSize:
+		m.Additional = rr.RRs{&rr.RR{".", rr.TYPE_OPT, rr.Class(size), optRR.TTL, &rr.OPT{}}}
+	}
+	return
+}
+
+// opt returns the OPT RR of m or nil if there is none.
+func opt(m *msg.Message) *rr.RR {
+	for _, rec := range m.Additional {
+		if rec.Type == rr.TYPE_OPT {
+			return rec
+		}
+	}
+	return nil
+}
+
+// ask sends the question to ip and returns the reply. EDNS is used unless ip
+// is known not to support it, advertising the UDP payload size negotiated
+// with ip. After a query with EDNS gets no reply, smaller sizes are
+// advertised to ip. If a server never seen supporting EDNS replies with a
+// FORMERR without an OPT RR or does not reply at all, the question is asked
+// again without EDNS and if that succeeds, the server is remembered not to
+// support EDNS (rfc6891/7). A BADCOOKIE reply is retried with the new
+// server cookie, first over UDP and then over TCP (rfc7873/5.3). A truncated
+// UDP reply is retried over TCP. If network is "tls" or "https", the question
+// is asked just once over DNS over TLS or DNS over HTTPS.
+func (r *Resolver) ask(ctx context.Context, network, sname string, stype msg.QType, sclass rr.Class, rd bool, ip net.IP, timeout time.Duration) (reply *msg.Message, err error) {
+	if network == "tls" || network == "https" {
+		return r.query(ctx, network, r.question(sname, stype, sclass, rd, ednsBufSize, ip), ip, timeout, true)
+	}
+
+	size, probe := r.stats.edns(ip)
+	m := r.question(sname, stype, sclass, rd, size, ip)
+	// The timeout of a probe is charged only if the server does not reply
+	// without EDNS either.
+	reply, err = r.query(ctx, "udp", m, ip, timeout, !probe)
+	if ctx.Err() != nil {
+		return
+	}
+
+	if size != 0 && errors.Is(err, context.DeadlineExceeded) {
+		r.stats.shrinkPayload(ip, size)
+	}
+
+	if size != 0 && probe && (err != nil || reply.RCODE == msg.RC_FORMAT_ERROR && opt(reply) == nil) {
+		if r.log.Level >= dns.LOG_DEBUG {
+			r.log.Log("%s @ %s: retrying without EDNS", m.Question, ip)
+		}
+		m = r.question(sname, stype, sclass, rd, 0, ip)
+		rx, e := r.query(ctx, "udp", m, ip, timeout, true)
+		if ctx.Err() != nil {
+			return rx, e
+		}
+
+		if e == nil && rx.RCODE != msg.RC_FORMAT_ERROR {
+			r.stats.noEDNS(ip)
+			reply, err, size = rx, nil, 0
+		}
+	}
+	if err != nil {
+		return
+	}
+
+	if size != 0 {
+		if x := opt(reply); x != nil {
+			r.stats.ednsSize(ip, uint16(x.Class))
+		}
+	}
+
+	if _, ok := cookie(m); ok && extRCODE(reply) == rcodeBADCOOKIE {
+		for _, network := range []string{"udp", "tcp"} {
+			if r.log.Level >= dns.LOG_DEBUG {
+				r.log.Log("%s @ %s: BADCOOKIE, retrying over %s", m.Question, ip, network)
+			}
+			m = r.question(sname, stype, sclass, rd, size, ip)
+			if reply, err = r.query(ctx, network, m, ip, timeout, true); err != nil {
+				return
+			}
+
+			if extRCODE(reply) != rcodeBADCOOKIE {
+				break
+			}
+		}
+		if extRCODE(reply) == rcodeBADCOOKIE {
+			return nil, fmt.Errorf("%s @ %s: BADCOOKIE", m.Question, ip)
+		}
+	}
+
+	if !reply.TC {
+		return
+	}
+
+	if r.log.Level >= dns.LOG_DEBUG {
+		r.log.Log("%s @ %s: truncated reply, retrying over TCP", m.Question, ip)
+	}
+	r.stats.truncated(ip)
+	if reply, err = r.query(ctx, "tcp", m, ip, timeout, true); err == nil && reply.TC {
+		reply, err = nil, fmt.Errorf("%s @ %s: truncated reply over TCP", m.Question, ip)
+	}
+	return
+}
+
+// query exchanges m with ip using network ("udp", "tcp", "tls" or "https"),
+// coalescing the exchange with any identical one already in flight. The
+// exchange is bounded by timeout. query returns when ctx is done, the exchange
+// is then aborted unless other callers still wait for it. A timeout is
+// charged to the statistics of ip only if charge is true, other failures and
+// rejected replies are always recorded. The reply, if any, is checked to be a
+// response to m, including the question section, a truncated reply is not
+// considered an error. The returned reply is never shared with other
+// callers, it may be modified.
+func (r *Resolver) query(ctx context.Context, network string, m *msg.Message, ip net.IP, timeout time.Duration, charge bool) (reply *msg.Message, err error) {
+	key := fmt.Sprintf("%s\x00%s\x00%t\x00%d\x00%s", network, ip, m.RD, len(m.Additional), strings.ToLower(m.Question.String()))
+	v, err, shared := r.flights.do(ctx, key, 0, func(ctx context.Context) (interface{}, error) {
+		x, err := r.exchanger(network, ip)
+		if err != nil {
+			return nil, err
+		}
+
+		if r.log.Level >= dns.LOG_DEBUG {
+			r.log.Log("\n%s(QUERY MSG @ %s %s)\n%s\n%s\n", qmark, network, ip, m, qmark)
+		}
+
+		// ctx is canceled only when no caller waits for the reply.
+		t0 := time.Now()
+		ctx2, cancel := context.WithTimeout(ctx, timeout)
+		reply, err := x.Exchange(ctx2, m)
+		cancel()
+		if err != nil {
+			switch {
+			case ctx.Err() != nil:
+				// abandoned, not the fault of ip
+			case errors.Is(err, context.DeadlineExceeded):
+				if charge {
+					r.stats.fail(ip, timeout)
+				}
+			default:
+				r.stats.broken(ip)
+			}
+			return nil, err
+		}
+
+		err = checkReply(m, reply)
+		if x20 := r.CaseRandomisation(); err == nil && x20 {
+			if err = checkQuestion(m, reply, true); err == nil {
+				uncase(m, reply)
+			}
+		}
+		if err == nil {
+			err = r.checkCookie(m, reply, ip)
 		}
+		if err != nil {
+			r.stats.reject(ip)
+			return nil, err
+		}
+
+		if network == "udp" { // TCP RTTs include the handshake
+			r.stats.rtt(ip, time.Since(t0))
+		}
+		w := dns.NewWirebuf()
+		reply.Encode(w)
+		return &flightReply{reply, w.Buf}, nil
+	})
+	if err != nil {
+		return
+	}
 
-		// !P && X
-		p.m[name] = true // P++
-		p.lock.Unlock()  // X--
+	x := v.(*flightReply)
+	if !shared {
+		return x.reply, nil
+	}
 
-		r.Lookup(name, q, rr.CLASS_IN, true) //TODO Param? Support anything outside CLASS_IN?
-		<-time.After(retry)
-		p.lock.Lock()     // X++
-		delete(p.m, name) // P--
+	if r.log.Level >= dns.LOG_DEBUG {
+		r.log.Log("%s @ %s: sharing reply of an in-flight exchange", m.Question, ip)
 	}
+	reply = &msg.Message{}
+	p := 0
+	if err = reply.Decode(x.wire, &p, nil); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+// flightReply is the result of a query flight. The reply belongs to the
+// caller which invoked the exchange, the callers sharing the flight decode
+// their own copies of it from wire.
+type flightReply struct {
+	reply *msg.Message
+	wire  []byte
+}
+
+// Separators of the messages dumped to the log.
+const (
+	qmark = "------------------------------------------------------------------------------"
+	rmark = "=============================================================================="
+)
 
-	go f(r.pendingA, msg.QTYPE_A)
-	go f(r.pendingAAAA, msg.QTYPE_AAAA)
+// wire returns the hex dump of the wire format of m, for the log. The reply
+// bytes are not kept, so m is encoded again, which may differ from what was
+// received, e.g. in name compression. m is not modified.
+func wire(m *msg.Message) string {
+	c := *m
+	b := dns.NewWirebuf()
+	c.Encode(b)
+	return hex.Dump(b.Buf)
 }
 
-var optRR = &rr.RR{".", rr.TYPE_OPT, rr.Class(4096), (&rr.EXT_RCODE{}).ToTTL(), &rr.OPT{}}
+// checkReply returns an error if reply is not a response to query. The
+// question sections must match, QNAMEs are compared case insensitively.
+func checkReply(query, reply *msg.Message) (err error) {
+	h := &reply.Header
+	if h.ID != query.Header.ID ||
+		!h.QR ||
+		h.Opcode != query.Header.Opcode ||
+		h.Z ||
+		int(h.QDCOUNT) != len(query.Question) {
+		return fmt.Errorf("rejected reply %s", h)
+	}
+
+	return checkQuestion(query, reply, false)
+}
 
 // Lookup is a general DNS lookup function (rfc1034/p.30). It attempts to
 // retrieve arbitrary information from the DNS. The caller supplies a sname,
@@ -401,6 +780,32 @@ var optRR = &rr.RR{".", rr.TYPE_OPT, rr.Class(4096), (&rr.EXT_RCODE{}).ToTTL(),
 // msg.Messsage.Header "Recursion Desired" flag. Lookup CNAMEs chain walked, if
 // any, is returned in redirects.
 func (r *Resolver) Lookup(sname string, stype msg.QType, sclass rr.Class, rd bool) (answer, redirects rr.RRs, result LookupResult, err error) {
+	return r.LookupContext(context.Background(), sname, stype, sclass, rd)
+}
+
+// LookupContext is like Lookup but the whole iterative resolution, including
+// any background lookups of missing nameserver addresses it starts, is
+// bounded by ctx. If ctx is canceled or its deadline passes before the
+// resolution completes, LookupContext returns result LookupFail with err set
+// to ctx.Err(), i.e. context.Canceled or context.DeadlineExceeded. Its
+// in-flight exchanges are aborted then, except for those shared with other
+// lookups, which run to completion for them. If DNS64 is configured, IN
+// AAAA and PTR lookups are subject to it, see SetDNS64.
+func (r *Resolver) LookupContext(ctx context.Context, sname string, stype msg.QType, sclass rr.Class, rd bool) (answer, redirects rr.RRs, result LookupResult, err error) {
+	if d := r.DNS64(); d != nil && sclass == rr.CLASS_IN {
+		switch stype {
+		case msg.QTYPE_AAAA:
+			return r.lookupAAAA64(ctx, d, sname, rd)
+		case msg.QTYPE_PTR:
+			return r.lookupPTR64(ctx, d, sname, rd)
+		}
+	}
+
+	return r.lookup(ctx, sname, stype, sclass, rd)
+}
+
+// lookup implements LookupContext except for DNS64.
+func (r *Resolver) lookup(ctx context.Context, sname string, stype msg.QType, sclass rr.Class, rd bool) (answer, redirects rr.RRs, result LookupResult, err error) {
 
 	defer func() {
 		if e := recover(); e != nil {
@@ -420,6 +825,22 @@ func (r *Resolver) Lookup(sname string, stype msg.QType, sclass rr.Class, rd boo
 	sname = dns.RootedName(strings.ToLower(sname))
 	aliases := map[string]bool{strings.ToLower(sname): true} // CNAME loop detection
 
+	qmin := r.QNameMinimisation()
+	var minimise bool              // QNAME minimisation is active for the current sname
+	var minLabels, minCount int    // labels known to exist, number of minimised queries sent
+	var qlabels int                // labels of a minimised qname
+	var slabels0 []string          // labels of sname
+	qname, qtype := sname, stype   // the question actually asked
+	var fwd, fwdFailed *Forwarding // forwarding rule in use, rule whose forwarders failed
+
+	tr := traceFrom(ctx)
+	if tr != nil {
+		name := sname
+		defer func() {
+			tr.add(TraceStep{Kind: TraceResult, Name: name, Type: stype, Result: result, Err: err})
+		}()
+	}
+
 	// rfc1034/5.3.3
 	// The top level algorithm has four steps:
 
@@ -428,8 +849,14 @@ step1:
 	//   1. See if the answer is in local information, and if so return
 	//      it to the client.
 
+	if err = ctx.Err(); err != nil {
+		result = LookupFail
+		return
+	}
+
 	bestmatch := -2 // sbelt has -1
 	nodata, nxdomain, sname0 := false, false, sname
+	minimise, minLabels, minCount = qmin != QNameMinOff && !rd, 0, 0
 
 	answer = r.cached(sname,
 
@@ -463,6 +890,19 @@ step1:
 			panic("unreachable")
 		})
 
+	if tr != nil {
+		switch {
+		case len(answer) != 0:
+			tr.add(TraceStep{Kind: TraceCache, Name: sname, Type: stype, RRs: answer})
+		case sname != sname0:
+			tr.add(TraceStep{Kind: TraceCache, Name: sname0, Type: stype, RRs: redirects[len(redirects)-1:], Note: "CNAME"})
+		case nxdomain:
+			tr.add(TraceStep{Kind: TraceCache, Name: sname, Type: stype, Note: "NXDOMAIN"})
+		case nodata:
+			tr.add(TraceStep{Kind: TraceCache, Name: sname, Type: stype, Note: "NODATA"})
+		}
+	}
+
 	switch {
 	case result == LookupAliasLoop:
 		return
@@ -483,6 +923,17 @@ step1:
 		return
 	}
 
+	if stype != msg.QTYPE_DNAME {
+		if dname := r.cachedDNAME(sname, sclass); dname != nil {
+			tr.add(TraceStep{Kind: TraceCache, Name: sname, Type: stype, RRs: rr.RRs{dname}, Note: "DNAME"})
+			if result = r.dname(dname, &sname, aliases, &redirects); result == LookupAliased {
+				goto step1
+			}
+
+			return
+		}
+	}
+
 step2:
 	//=================================================================
 	//   2. Find the best servers to ask.
@@ -506,6 +957,13 @@ step2:
 
 	slist = &srvlist{conf: r.getQueryConf()}
 	srvmap := map[string]bool{}
+	fwd = nil
+	if rule := r.forwardingFor(sname); rule != nil && rule != fwdFailed {
+		if r.log.Level >= dns.LOG_DEBUG {
+			r.log.Log("%q: forwarding to %v", sname, rule.Forwarders)
+		}
+		fwd, slist, slabels = rule, r.forwarders(rule), nil
+	}
 
 	for len(slabels) != 0 {
 		q := strings.Join(slabels, ".")
@@ -581,7 +1039,7 @@ step2:
 				// missing glue record(s) or their expired
 				// TTLs.  Enter emergency panic mode for the
 				// missing address(es).
-				r.needNSAdr(nsdname)
+				r.needNSAdr(ctx, nsdname)
 				retry++
 
 			}
@@ -595,7 +1053,13 @@ step2:
 			r.log.Log("%q: using sbelt", sname)
 		}
 	}
-	sort.Sort(slist)
+	if !slist.ordered {
+		for i := range slist.servers {
+			srv := &slist.servers[i]
+			srv.ips, srv.srtt = r.stats.order(srv.ips)
+		}
+	}
+	sort.Stable(slist)
 	iserver = 0
 
 step3:
@@ -605,8 +1069,6 @@ step3:
 	if r.log.Level >= dns.LOG_DEBUG {
 		r.log.Log("slist servers %d", len(slist.servers))
 	}
-	rxbuf := make([]byte, 4500)
-
 asking:
 	for {
 		if len(slist.servers) == 0 {
@@ -618,6 +1080,14 @@ asking:
 		}
 
 		if iserver >= len(slist.servers) {
+			if fwd != nil && fwd.Forward == named.ForwardFirst {
+				if r.log.Level >= dns.LOG_DEBUG {
+					r.log.Log("Lookup %q no valid response from forwarders, resolving iteratively", sname)
+				}
+				fwdFailed, retry = fwd, 0
+				goto step2
+			}
+
 			if r.log.Level >= dns.LOG_DEBUG {
 				r.log.Log("Lookup %q giving up without getting a valid response", sname)
 			}
@@ -636,102 +1106,128 @@ asking:
 			}
 
 			// retry due to pending NS addresses requests
-			<-time.After(1e9 / 2)
+			select {
+			case <-time.After(1e9 / 2):
+			case <-ctx.Done():
+				err, result = ctx.Err(), LookupFail
+				return
+			}
 			retry >>= 1
 			goto step2
 
 		}
 
-		const qmark = "------------------------------------------------------------------------------"
-		const rmark = "=============================================================================="
+		qname, qtype = sname, stype
+		if minimise && srv.matchcount >= 0 {
+			if slabels0 == nil || minimisedName(slabels0, len(slabels0)) != sname {
+				if slabels0, err = dns.Labels(sname); err != nil {
+					return
+				}
+			}
 
-		const (
-			attemptUDP = iota
-			attemptENDS
-		)
+			if srv.matchcount > minLabels {
+				minLabels = srv.matchcount
+			}
+			if qlabels = minimisedLabels(minLabels, len(slabels0), minCount); qlabels < len(slabels0) {
+				qname, qtype = minimisedName(slabels0, qlabels), msg.QTYPE_A
+			}
+		}
 
 		// try server srv
 		for attempts := 0; attempts < srv.attempts; attempts++ {
 			for _, ip = range srv.ips {
-
-				attempting := attemptUDP
-
-			reAttempt:
-				m := msg.New()
-				m.Question.Append(sname, stype, sclass)
-				if attempting == attemptENDS {
-					m.Additional = rr.RRs{optRR}
-				}
-				m.Header.RD = rd // Recursion Desired
 				if r.log.Level >= dns.LOG_TRACE {
-					if r.log.Level >= dns.LOG_DEBUG {
-						r.log.Log("\n%s(QUERY MSG for %q @ %s)\n%s\n%s\n", qmark, srv.name, ip, m, qmark)
-					} else {
-						r.log.Log("asking %q @ %s, Q: %s", srv.name, ip, m.Question)
-					}
+					r.log.Log("asking %q @ %s, Q: %s %s %s", srv.name, ip, qname, qtype, sclass)
 				}
-				adr, err := net.ResolveUDPAddr("udp", ip.String()+":53")
-				if err != nil {
-					if r.log.Level >= dns.LOG_ERRORS {
-						r.log.Log("FAIL net.ResolveUDPAddr: %s", err)
-					}
-					continue
+				t0 := time.Now()
+				network := "udp"
+				switch {
+				case srv.matchcount >= 0:
+					// not an upstream, i.e. neither SBELT nor forwarders
+				case r.DoH() != nil:
+					network = "https"
+				case r.DoT() != nil:
+					network = "tls"
 				}
-				c, err := net.DialUDP("udp", nil, adr)
-				if err != nil {
-					if r.log.Level >= dns.LOG_ERRORS {
-						r.log.Log("FAIL net.DialUDP: %s", err)
+				rx, e := r.ask(ctx, network, qname, qtype, sclass, rd || fwd != nil, ip, time.Duration(slist.conf.Conf.Opt.TimeoutSecs)*time.Second)
+				if tr != nil {
+					step := TraceStep{Kind: TraceQuery, Time: t0, Duration: time.Since(t0), Name: qname, Type: qtype, Zone: srv.zone, Server: srv.name, IP: ip, Reply: rx, Err: e}
+					if qname != sname {
+						step.Note = "minimised"
 					}
-					continue
+					tr.add(step)
 				}
+				if e != nil {
+					if ctx.Err() != nil {
+						err, result = ctx.Err(), LookupFail
+						return
+					}
 
-				defer c.Close()
-
-				c.SetDeadline(time.Now().Add(time.Duration(slist.conf.Conf.Opt.TimeoutSecs) * time.Second))
-				var rxbytes int
-				if rxbytes, reply, err = m.ExchangeBuf(c, rxbuf); err != nil {
 					if r.log.Level >= dns.LOG_ERRORS {
-						r.log.Log("FAIL ExchangeBuf: %s", err)
+						r.log.Log("FAIL query: %s", e)
 					}
 					continue
 				}
 
+				reply = rx
+
 				// got a response
 				if r.log.Level >= dns.LOG_TRACE {
 					if r.log.Level >= dns.LOG_DEBUG {
-						r.log.Log("\n%s(REPLY MSG from %q @ %s)\n%s\nWire:\n%s\n%s\n", rmark, srv.name, ip, reply, hex.Dump(rxbuf[:rxbytes]), rmark)
+						r.log.Log("\n%s(REPLY MSG from %q @ %s)\n%s\nWire:\n%s\n%s\n", rmark, srv.name, ip, reply, wire(reply), rmark)
 					} else {
 						r.log.Log("got a response for %q from %q @ %s", sname, srv.name, ip)
 					}
 				}
-				h := &reply.Header
-
-				if h.TC {
-					switch attempting {
-					case attemptUDP:
-						attempting = attemptENDS
-						goto reAttempt
-					}
-				}
+				break asking // response accepted
 
-				reject := h.ID != m.Header.ID ||
-					!h.QR ||
-					h.Opcode != m.Header.Opcode ||
-					h.TC ||
-					h.Z ||
-					h.QDCOUNT != m.Header.QDCOUNT
+			}
+		}
 
-				if reject {
-					continue
+		iserver++
+	}
 
+	if qname != sname { // rfc9156/2.3
+		minCount++
+		switch {
+		case reply.RCODE == msg.RC_NAME_ERROR && qmin == QNameMinStrict:
+			soas, _ := reply.Authority.Filter(func(r *rr.RR) bool {
+				return sclass == r.Class && r.Type == rr.TYPE_SOA
+			})
+			if reply.AA && len(soas) == 1 {
+				ttl := soas[0].TTL
+				if ttl2 := int32(soas[0].RData.(*rr.SOA).Minimum); ttl2 < ttl {
+					ttl = ttl2
 				}
+				r.cache.AddRank(cache.RankAuthAnswer, rr.RRs{&rr.RR{qname, rr.TYPE_NXDOMAIN, sclass, ttl, &rr.NXDOMAIN{}}})
+			}
 
-				break asking // response accepted
-
+			switch result {
+			case LookupAliased:
+				result = LookupAliasError
+			default:
+				result = LookupNameError
+			}
+			return
+		case reply.RCODE == msg.RC_NO_ERROR && isReferral(reply, qname, sclass, srv.matchcount):
+			minLabels = qlabels
+			// process the referral below
+		case reply.RCODE == msg.RC_NO_ERROR && !hasCNAME(reply, qname):
+			// qname exists, possibly as an ENT, ask the same server for more labels
+			minLabels = qlabels
+			goto step3
+		case reply.RCODE == msg.RC_NO_ERROR, qmin == QNameMinRelaxed:
+			// qname is an alias or the server does not handle minimised queries well
+			if r.log.Level >= dns.LOG_DEBUG {
+				r.log.Log("%q: %s for minimised %q, asking for the full QNAME", sname, reply.RCODE, qname)
 			}
+			minimise = false
+			goto step3
+		default:
+			r.stats.lame(ip)
+			iserver++
+			goto step3
 		}
-
-		iserver++
 	}
 
 	if srv.matchcount <= bestmatch {
@@ -741,22 +1237,32 @@ asking:
 	if r.log.Level > dns.LOG_DEBUG {
 		r.log.Log("%q bestmatch %d -> %d", sname, bestmatch, srv.matchcount)
 	}
+	bestmatch0 := bestmatch
 	bestmatch = srv.matchcount
 
 	//step4:
 
+	zone := srv.zone
+	if srv.matchcount < 0 { // SBELT and forwarders are trusted with any name
+		zone = "."
+	}
+	ranswer, rauthority, radditional, dropped := scrub(reply, zone)
+	if dropped != 0 && r.log.Level >= dns.LOG_DEBUG {
+		r.log.Log("%q: dropped %d out of bailiwick RRs of a reply from %q (zone %q) @ %s", sname, dropped, srv.name, zone, ip)
+	}
+
 	other := rr.RRs{}
 	cnames := rr.RRs{} // only those matching sname
 	soa := (*rr.RR)(nil)
 	soadata := (*rr.SOA)(nil)
 
-	answer, other = reply.Answer.Filter(func(r *rr.RR) bool {
+	answer, other = ranswer.Filter(func(r *rr.RR) bool {
 		return sclass == r.Class && (stype == msg.QTYPE_STAR || r.Type == rr.Type(stype)) && strings.ToLower(r.Name) == sname
 	})
 	cnames, other = other.Filter(func(r *rr.RR) bool {
 		return sclass == r.Class && r.Type == rr.TYPE_CNAME && strings.ToLower(r.Name) == sname
 	})
-	soas, ns := reply.Authority.Filter(func(r *rr.RR) bool {
+	soas, ns := rauthority.Filter(func(r *rr.RR) bool {
 		return sclass == r.Class && r.Type == rr.TYPE_SOA
 	})
 	// Authority NSs sanity check
@@ -769,6 +1275,22 @@ asking:
 		soadata = soa.RData.(*rr.SOA)
 	}
 
+	// rfc6672/3.4 A DNAME applies to sname, the CNAME synthesized by the
+	// server is replaced by our own.
+	if dname := dnameFor(other, sname, sclass); dname != nil && len(answer) == 0 && stype != msg.QTYPE_DNAME {
+		_, ranswer = ranswer.Filter(func(r *rr.RR) bool {
+			return r.Type == rr.TYPE_CNAME && strings.ToLower(r.Name) == sname
+		})
+		r.cacheReply(reply.AA, ranswer, soas, ns, radditional)
+		alias, nredirects := sname, len(redirects)
+		if result = r.dname(dname, &sname, aliases, &redirects); result != LookupAliased {
+			return
+		}
+
+		tr.add(TraceStep{Kind: TraceAlias, Name: alias, Type: stype, RRs: redirects[nredirects:]})
+		goto step1
+	}
+
 	//=================================================================
 	//   4. Analyze the response, either:
 
@@ -779,12 +1301,16 @@ asking:
 	//            error, cache the data as well as returning it back to
 	//            the client.
 	case reply.RCODE == msg.RC_NO_ERROR && len(answer) != 0:
-		r.cache.Add(reply.Answer, soas, ns, reply.Additional)
+		if r.cacheable(stype) {
+			r.cacheReply(reply.AA, ranswer, soas, ns, radditional)
+		} else {
+			r.cacheReply(reply.AA, nil, soas, ns, radditional)
+		}
 		answer.Unique() // improve some bad configured server responses
 		return
 
 	case reply.RCODE == msg.RC_NAME_ERROR:
-		r.cache.Add(reply.Answer, soas, ns, reply.Additional)
+		r.cacheReply(reply.AA, ranswer, soas, ns, radditional)
 
 		//   rfc2038/5 cache NXDOMAIN
 		if reply.AA && len(soas) == 1 {
@@ -792,7 +1318,7 @@ asking:
 			if ttl2 := int32(soadata.Minimum); ttl2 < ttl {
 				ttl = ttl2
 			}
-			r.cache.Add(rr.RRs{&rr.RR{sname, rr.TYPE_NXDOMAIN, sclass, ttl, &rr.NXDOMAIN{}}})
+			r.cache.AddRank(cache.RankAuthAnswer, rr.RRs{&rr.RR{sname, rr.TYPE_NXDOMAIN, sclass, ttl, &rr.NXDOMAIN{}}})
 		}
 
 		switch result {
@@ -811,7 +1337,7 @@ asking:
 	//   no relevant answers in the answer section.  The authority section
 	//   will contain an SOA record, or there will be no NS records there.
 	case reply.RCODE == msg.RC_NO_ERROR && reply.ANCOUNT == 0 && (len(soas) == 1 || len(ns) == 0):
-		r.cache.Add(reply.Answer, soas, ns, reply.Additional)
+		r.cacheReply(reply.AA, ranswer, soas, ns, radditional)
 
 		//   rfc2038/5 cache NODATA
 		if reply.AA {
@@ -819,7 +1345,7 @@ asking:
 			if ttl2 := int32(soadata.Minimum); ttl2 < ttl {
 				ttl = ttl2
 			}
-			r.cache.Add(rr.RRs{&rr.RR{sname, rr.TYPE_NODATA, sclass, ttl, &rr.NODATA{rr.Type(stype)}}})
+			r.cache.AddRank(cache.RankAuthAnswer, rr.RRs{&rr.RR{sname, rr.TYPE_NODATA, sclass, ttl, &rr.NODATA{rr.Type(stype)}}})
 		}
 		result = LookupDataNotFound
 		return
@@ -829,10 +1355,11 @@ asking:
 	//            answer itself, cache the CNAME, change the SNAME to the
 	//            canonical name in the CNAME RR and go to step 1.
 	case reply.RCODE == msg.RC_NO_ERROR && len(cnames) == 1:
-		r.cache.Add(reply.Answer, soas, ns, reply.Additional)
+		r.cacheReply(reply.AA, ranswer, soas, ns, radditional)
 
 		cn := cnames[0]
 		cname := cn.RData.(*rr.CNAME)
+		alias, nredirects := sname, len(redirects)
 		for chain := true; chain; {
 
 			sname = strings.ToLower(cname.Name) // next name in chain
@@ -852,6 +1379,7 @@ asking:
 				}
 			}
 		}
+		tr.add(TraceStep{Kind: TraceAlias, Name: alias, Type: stype, RRs: redirects[nredirects:]})
 		result = LookupAliased
 		goto step1
 
@@ -859,15 +1387,32 @@ asking:
 	//       4.b. if the response contains a better delegation to other
 	//            servers, cache the delegation information, and go to
 	//            step 2.
-	case reply.RCODE == msg.RC_NO_ERROR && len(ns) != 0:
-		r.cache.Add(soas, ns, reply.Additional)
+	case reply.RCODE == msg.RC_NO_ERROR && len(ns) != 0 && fwd == nil: // forwarders don't refer
+		r.cacheReply(reply.AA, nil, soas, ns, radditional)
+		tr.add(TraceStep{Kind: TraceReferral, Name: sname, Type: stype, Zone: ns[0].Name, RRs: ns})
 		goto step2
 
+	//-----------------------------------------------------------------
+	//   rfc6672/2.2 - The DNAME substitution of sname by the server
+	//   overflowed the maximum name length. A DNAME present in the reply
+	//   was already handled above.
+	case reply.RCODE == msg.RC_YXDOMAIN:
+		r.cacheReply(reply.AA, ranswer, soas, ns, radditional)
+		result = LookupYXDomain
+		return
+
 	//-----------------------------------------------------------------
 	//       4.d. if the response shows a servers failure or other
 	//            bizarre contents, delete the server from the SLIST and
 	//            go back to step 3.
 	default:
+		r.stats.lame(ip)
+		if srv.matchcount < 0 {
+			// An upstream failed, try the next one. No progress was
+			// made, so the failed one must not raise bestmatch.
+			bestmatch = bestmatch0
+			iserver++
+		}
 		goto step3 // "delete from the SLIST" is performed by iserver incrementing in step 3
 	}
 
@@ -880,11 +1425,13 @@ type server struct {
 	matchcount int
 	name       string
 	ips        []net.IP
+	srtt       time.Duration // of the first of ips
 }
 
 type srvlist struct {
 	conf    *queryConf
 	servers []server
+	ordered bool // use servers in the configured order, i.e. the SBELT
 }
 
 // Implementation of sort.Interface
@@ -894,7 +1441,12 @@ func (s *srvlist) Len() int {
 
 // Implementation of sort.Interface
 func (s *srvlist) Less(i, j int) bool {
-	return s.servers[i].matchcount > s.servers[j].matchcount // sort descending matchcounts
+	a, b := &s.servers[i], &s.servers[j]
+	if a.matchcount != b.matchcount {
+		return a.matchcount > b.matchcount // sort descending matchcounts
+	}
+
+	return a.srtt < b.srtt // then the fastest first
 }
 
 // Implementation of sort.Interface
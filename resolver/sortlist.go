@@ -0,0 +1,86 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"github.com/cznic/dns/resolv"
+	"net"
+	"sort"
+)
+
+// naturalMask returns the classful netmask of the IPv4 address ip4.
+func naturalMask(ip4 net.IP) net.IP {
+	switch b := ip4[0]; {
+	case b < 128: // class A
+		return net.IPv4(255, 0, 0, 0).To4()
+	case b < 192: // class B
+		return net.IPv4(255, 255, 0, 0).To4()
+	default:
+		return net.IPv4(255, 255, 255, 0).To4()
+	}
+}
+
+// sortlistIndex returns the index of the first item of list matching ip or
+// len(list) if there is none. Like glibc, only IPv4 addresses are matched.
+func sortlistIndex(list []resolv.SortlistItem, ip net.IP) int {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return len(list)
+	}
+
+	for i, item := range list {
+		addr := item.Addr.To4()
+		if addr == nil {
+			continue
+		}
+
+		mask := item.NetMask.To4()
+		if mask == nil {
+			mask = naturalMask(addr)
+		}
+		if ip4.Mask(net.IPMask(mask)).Equal(addr.Mask(net.IPMask(mask))) {
+			return i
+		}
+	}
+	return len(list)
+}
+
+type sortlisted struct {
+	ips []net.IP
+	ix  []int
+}
+
+// Implementation of sort.Interface
+func (s *sortlisted) Len() int {
+	return len(s.ips)
+}
+
+// Implementation of sort.Interface
+func (s *sortlisted) Less(i, j int) bool {
+	return s.ix[i] < s.ix[j]
+}
+
+// Implementation of sort.Interface
+func (s *sortlisted) Swap(i, j int) {
+	s.ips[i], s.ips[j] = s.ips[j], s.ips[i]
+	s.ix[i], s.ix[j] = s.ix[j], s.ix[i]
+}
+
+// sortIPs reorders ips in place according to the resolv.conf sortlist: IPs
+// matching an earlier sortlist item come first, IPs not matching any item go
+// last. The order of IPs matching the same item is preserved.
+func sortIPs(list []resolv.SortlistItem, ips []net.IP) {
+	if len(list) == 0 || len(ips) < 2 {
+		return
+	}
+
+	s := &sortlisted{ips, make([]int, len(ips))}
+	for i, ip := range ips {
+		s.ix[i] = sortlistIndex(list, ip)
+	}
+	sort.Stable(s)
+}
@@ -0,0 +1,333 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	maxSRTT      = 10 * time.Second // penalized SRTT cap
+	maxBackoff   = 5 * time.Minute  // longest time a server is avoided
+	backoffAfter = 3                // consecutive failures before backing off
+	probeRatio   = 20               // one of probeRatio selections probes a random server
+	noEDNSTime   = time.Hour        // how long is EDNS not used with a server which failed it
+)
+
+// UDP payload sizes advertised in EDNS queries (rfc6891/6.2.5).
+const (
+	ednsBufSize  = 4096 // the receive buffer size, advertised to servers by default
+	ednsSafeSize = 1232 // avoids IP fragmentation on common paths
+	ednsMinSize  = 512  // the DNS over UDP message size limit
+)
+
+// ServerStats are the statistics a Resolver keeps about a nameserver IP.
+type ServerStats struct {
+	SRTT         time.Duration // Smoothed round trip time, zero if not yet known.
+	Queries      int           // Number of queries sent.
+	Failures     int           // Number of queries which timed out or failed otherwise, e.g. by a refused connection.
+	Rejected     int           // Number of replies rejected as not matching their query.
+	Lame         int           // Number of replies which were lame or bizarre.
+	Consecutive  int           // Number of consecutive failed or lame queries.
+	BackoffUntil time.Time     // The server is avoided until BackoffUntil.
+	EDNS         uint16        // UDP payload size advertised by the server, zero if not yet known.
+	PayloadSize  uint16        // UDP payload size advertised to the server, zero if not yet reduced from the default.
+	NoEDNSUntil  time.Time     // EDNS is not used with the server until NoEDNSUntil.
+	Truncated    int           // Number of truncated UDP replies, retried over TCP.
+	ServerCookie []byte        // The last rfc7873 server cookie received, if any.
+}
+
+func (s *ServerStats) String() string {
+	return fmt.Sprintf(
+		"SRTT:%s Queries:%d Failures:%d Rejected:%d Lame:%d Consecutive:%d BackoffUntil:%s EDNS:%d PayloadSize:%d NoEDNSUntil:%s Truncated:%d ServerCookie:%x",
+		s.SRTT, s.Queries, s.Failures, s.Rejected, s.Lame, s.Consecutive, s.BackoffUntil.Format(time.RFC3339),
+		s.EDNS, s.PayloadSize, s.NoEDNSUntil.Format(time.RFC3339), s.Truncated, s.ServerCookie,
+	)
+}
+
+// serverStats maps nameserver IPs to their ServerStats.
+type serverStats struct {
+	m    map[string]*ServerStats
+	lock sync.Mutex
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{m: map[string]*ServerStats{}}
+}
+
+// get returns the stats of ip. s must be locked.
+func (s *serverStats) get(ip net.IP) (y *ServerStats) {
+	k := ip.String()
+	if y = s.m[k]; y == nil {
+		y = &ServerStats{}
+		s.m[k] = y
+	}
+	return
+}
+
+// rtt records a valid reply from ip received after d.
+func (s *serverStats) rtt(ip net.IP, d time.Duration) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	x := s.get(ip)
+	x.Queries++
+	x.Consecutive = 0
+	x.BackoffUntil = time.Time{}
+	switch {
+	case x.SRTT == 0:
+		x.SRTT = d
+	default:
+		x.SRTT = (7*x.SRTT + d) / 8
+	}
+}
+
+// fail records a query to ip which got no reply within timeout.
+func (s *serverStats) fail(ip net.IP, timeout time.Duration) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	x := s.get(ip)
+	x.Queries++
+	x.Failures++
+	switch {
+	case x.SRTT < timeout:
+		x.SRTT = timeout
+	default:
+		x.SRTT *= 2
+	}
+	if x.SRTT > maxSRTT {
+		x.SRTT = maxSRTT
+	}
+	s.backoff(x)
+}
+
+// broken records a query to ip which failed without a timeout, e.g. by a
+// refused connection. The SRTT of ip is kept, it says nothing about the time
+// ip takes to reply.
+func (s *serverStats) broken(ip net.IP) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	x := s.get(ip)
+	x.Queries++
+	x.Failures++
+	s.backoff(x)
+}
+
+// reject records a reply from ip which was rejected as not matching its
+// query. Such replies may be forged by a third party, so ip is neither
+// penalized nor backed off.
+func (s *serverStats) reject(ip net.IP) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	x := s.get(ip)
+	x.Queries++
+	x.Rejected++
+}
+
+// lame records a lame or otherwise unusable reply from ip.
+func (s *serverStats) lame(ip net.IP) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	x := s.get(ip)
+	x.Lame++
+	s.backoff(x)
+}
+
+func (s *serverStats) backoff(x *ServerStats) {
+	x.Consecutive++
+	if n := x.Consecutive - backoffAfter; n >= 0 {
+		d := time.Second << uint(n)
+		if d > maxBackoff || d <= 0 {
+			d = maxBackoff
+		}
+		x.BackoffUntil = time.Now().Add(d)
+	}
+}
+
+// edns returns the UDP payload size to advertise to ip, zero if EDNS should
+// not be used with ip. The size is ednsBufSize or the smaller one ip is known
+// to cope with, limited by the size ip advertises, but never less than
+// ednsMinSize. The returned probe is true if ip was never seen supporting
+// EDNS.
+func (s *serverStats) edns(ip net.IP) (size uint16, probe bool) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	x, ok := s.m[ip.String()]
+	if !ok {
+		return ednsBufSize, true
+	}
+
+	if time.Now().Before(x.NoEDNSUntil) {
+		return 0, false
+	}
+
+	size = ednsBufSize
+	if x.PayloadSize != 0 {
+		size = x.PayloadSize
+	}
+	if x.EDNS != 0 && x.EDNS < size {
+		size = x.EDNS
+	}
+	return size, x.EDNS == 0
+}
+
+// shrinkPayload records that an EDNS query advertising size to ip got no
+// reply. Large replies may have been lost to IP fragmentation, so the next
+// queries advertise ednsSafeSize and then ednsMinSize.
+func (s *serverStats) shrinkPayload(ip net.IP, size uint16) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	x := s.get(ip)
+	switch {
+	case size > ednsSafeSize:
+		x.PayloadSize = ednsSafeSize
+	default:
+		x.PayloadSize = ednsMinSize
+	}
+}
+
+// noEDNS records that ip failed to handle an EDNS query.
+func (s *serverStats) noEDNS(ip net.IP) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	x := s.get(ip)
+	x.EDNS = 0
+	x.NoEDNSUntil = time.Now().Add(noEDNSTime)
+}
+
+// ednsSize records the UDP payload size advertised by ip.
+func (s *serverStats) ednsSize(ip net.IP, size uint16) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	if size < ednsMinSize { // rfc6891/6.2.5
+		size = ednsMinSize
+	}
+	s.get(ip).EDNS = size
+}
+
+// truncated records a truncated UDP reply from ip.
+func (s *serverStats) truncated(ip net.IP) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	s.get(ip).Truncated++
+}
+
+// serverCookie returns the last server cookie received from ip, if any.
+func (s *serverStats) serverCookie(ip net.IP) []byte {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	if x, ok := s.m[ip.String()]; ok {
+		return x.ServerCookie
+	}
+
+	return nil
+}
+
+// setServerCookie records the server cookie received from ip.
+func (s *serverStats) setServerCookie(ip net.IP, cookie []byte) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	s.get(ip).ServerCookie = append([]byte(nil), cookie...)
+}
+
+// srtt returns the SRTT of ip and whether ip is backed off.
+func (s *serverStats) srtt(ip net.IP, now time.Time) (d time.Duration, backedOff bool) {
+	s.lock.Lock()         // X++
+	defer s.lock.Unlock() // X--
+
+	if x, ok := s.m[ip.String()]; ok {
+		return x.SRTT, now.Before(x.BackoffUntil)
+	}
+
+	return
+}
+
+type rankedIPs struct {
+	ips  []net.IP
+	srtt []time.Duration
+}
+
+// Implementation of sort.Interface
+func (r *rankedIPs) Len() int {
+	return len(r.ips)
+}
+
+// Implementation of sort.Interface
+func (r *rankedIPs) Less(i, j int) bool {
+	return r.srtt[i] < r.srtt[j]
+}
+
+// Implementation of sort.Interface
+func (r *rankedIPs) Swap(i, j int) {
+	r.ips[i], r.ips[j] = r.ips[j], r.ips[i]
+	r.srtt[i], r.srtt[j] = r.srtt[j], r.srtt[i]
+}
+
+// order returns ips in the order they should be asked, the fastest first.
+// Backed off IPs are left out unless all of ips are backed off. Unknown
+// servers have zero SRTT and are thus probed first. Additionally, once in a
+// while a random one of the other servers is put first to refresh its SRTT.
+// The returned best is the SRTT of the first IP or the maximum duration if all
+// of ips are backed off.
+func (s *serverStats) order(ips []net.IP) (y []net.IP, best time.Duration) {
+	now := time.Now()
+	var ok, off rankedIPs
+	for _, ip := range ips {
+		d, backedOff := s.srtt(ip, now)
+		x := &ok
+		if backedOff {
+			x = &off
+		}
+		x.ips = append(x.ips, ip)
+		x.srtt = append(x.srtt, d)
+	}
+	allOff := len(ok.ips) == 0
+	if allOff {
+		ok = off
+	}
+	sort.Stable(&ok)
+	if n := len(ok.ips); n > 1 && rand.Intn(probeRatio) == 0 {
+		ok.Swap(0, 1+rand.Intn(n-1))
+	}
+	switch {
+	case allOff:
+		best = math.MaxInt64
+	case len(ok.ips) != 0:
+		best = ok.srtt[0]
+	}
+	return ok.ips, best
+}
+
+// ServerStats returns a snapshot of the statistics the Resolver keeps about
+// the nameservers it has asked, keyed by the string form of their IPs.
+func (r *Resolver) ServerStats() (m map[string]ServerStats) {
+	r.stats.lock.Lock()         // X++
+	defer r.stats.lock.Unlock() // X--
+
+	m = make(map[string]ServerStats, len(r.stats.m))
+	for k, v := range r.stats.m {
+		m[k] = *v
+	}
+	return
+}
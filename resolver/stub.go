@@ -0,0 +1,345 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/resolv"
+	"github.com/cznic/dns/rr"
+	"github.com/cznic/dns/transport"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// StubReply is the result of a Stub lookup.
+type StubReply struct {
+	Name      string       // The candidate name the reply is for, i.e. the name with a search domain appended, if any.
+	Result    LookupResult // LookupOK, LookupAliased, LookupNameError, LookupDataNotFound, LookupAliasLoop, LookupAliasError or LookupFail.
+	Answer    rr.RRs       // RRs of the requested type owned by Name or by the end of its CNAME chain.
+	Redirects rr.RRs       // The CNAME chain walked, if any.
+	Server    net.IP       // The nameserver which replied.
+	Msg       *msg.Message // The reply, nil if no nameserver replied.
+}
+
+// Stub is a stub resolver. Unlike Resolver it performs no iteration and has
+// no cache, it just sends queries with the RD flag set to the nameservers
+// listed in resolv.conf. Names are expanded using the search list and the
+// ndots option and the nameservers are asked honoring the attempts, timeout
+// and rotate options the same way glibc does. Stub is safe for concurrent
+// use.
+type Stub struct {
+	conf     func() (*resolv.Conf, error)
+	hostName string
+	log      *dns.Logger
+	rotate   uint32
+}
+
+// NewStub returns a new Stub or an error if any. 'resolvFName' is like
+// "/etc/resolv.conf" and may be empty in which case resolv.Sys will be used.
+// Modifications of the file are picked up on the next lookup. 'logger' may be
+// nil.
+func NewStub(resolvFName string, logger *dns.Logger) (s *Stub, err error) {
+	if logger == nil {
+		logger = dns.NoLogger
+	}
+	if resolvFName == "" {
+		resolvFName = resolv.Sys
+	}
+
+	var cfg *resolv.Cfg
+	if cfg, err = resolv.NewCfg(resolvFName, logger); err != nil {
+		return
+	}
+
+	s = NewStubConf(nil, logger)
+	s.conf = func() (c *resolv.Conf, err error) {
+		c, _, err = cfg.Conf()
+		return
+	}
+	return
+}
+
+// NewStubConf returns a new Stub using conf, which must not be modified
+// afterwards. 'logger' may be nil.
+func NewStubConf(conf *resolv.Conf, logger *dns.Logger) (s *Stub) {
+	if logger == nil {
+		logger = dns.NoLogger
+	}
+	s = &Stub{log: logger, conf: func() (*resolv.Conf, error) { return conf, nil }}
+	s.hostName, _ = os.Hostname()
+	return
+}
+
+// Candidates returns the list of names to query for name in the order glibc
+// res_search would try them.
+func (s *Stub) Candidates(name string) (list []string, err error) {
+	var c *resolv.Conf
+	if c, err = s.conf(); err != nil {
+		return
+	}
+
+	return s.candidates(c, name), nil
+}
+
+func (s *Stub) candidates(c *resolv.Conf, name string) (list []string) {
+	if dns.IsRooted(name) {
+		return []string{name}
+	}
+
+	search := c.Search
+	if len(search) == 0 {
+		domain := c.Domain
+		if domain == "" {
+			domain = dns.Host2domain(s.hostName)
+		}
+		if domain != "" {
+			search = []string{domain}
+		}
+	}
+
+	absolute := dns.RootedName(name)
+	dots := strings.Count(name, ".")
+	if dots >= int(c.Opt.Ndots) {
+		list = append(list, absolute)
+	}
+	for _, domain := range search {
+		if domain = strings.TrimSuffix(domain, "."); domain != "" {
+			list = append(list, absolute+domain+".")
+		}
+	}
+	if dots < int(c.Opt.Ndots) {
+		list = append(list, absolute)
+	}
+	return
+}
+
+// Lookup queries the nameservers for the RRs of type stype and class sclass
+// owned by name, trying the search list candidates of name. Lookup continues
+// with the next candidate if the previous one does not exist, has no data of
+// stype or if no nameserver could answer it, like glibc does. The first
+// successful reply is returned, otherwise the returned StubReply reports
+// LookupDataNotFound if any candidate exists, LookupFail if any candidate
+// could not be resolved and LookupNameError otherwise. A non-nil error is
+// returned for configuration errors.
+func (s *Stub) Lookup(name string, stype msg.QType, sclass rr.Class) (y *StubReply, err error) {
+	return s.LookupContext(context.Background(), name, stype, sclass)
+}
+
+// LookupContext is like Lookup but the lookup is bounded by ctx. If ctx is
+// done before the lookup completes, the returned StubReply reports LookupFail
+// and err is ctx.Err().
+func (s *Stub) LookupContext(ctx context.Context, name string, stype msg.QType, sclass rr.Class) (y *StubReply, err error) {
+	var c *resolv.Conf
+	if c, err = s.conf(); err != nil {
+		return
+	}
+
+	var nodata, fail *StubReply
+	for _, cand := range s.candidates(c, strings.TrimSpace(name)) {
+		if y, err = s.query(ctx, c, cand, stype, sclass); err != nil {
+			return
+		}
+
+		switch y.Result {
+		case LookupNameError:
+			// next candidate
+		case LookupDataNotFound:
+			if nodata == nil {
+				nodata = y
+			}
+		case LookupFail:
+			if fail == nil {
+				fail = y
+			}
+		default:
+			return
+		}
+	}
+
+	switch {
+	case nodata != nil:
+		y = nodata
+	case fail != nil:
+		y = fail
+	case y == nil:
+		y = &StubReply{Name: name, Result: LookupNameError}
+	}
+	return
+}
+
+// query asks the nameservers of c for name. The nameservers are tried in
+// rounds of c.Opt.Attempts, glibc res_send style.
+func (s *Stub) query(ctx context.Context, c *resolv.Conf, name string, stype msg.QType, sclass rr.Class) (y *StubReply, err error) {
+	y = &StubReply{Name: name, Result: LookupFail}
+	servers := c.Nameserver
+	if len(servers) == 0 {
+		servers = []net.IP{dns.DefaultLocalNameServer()}
+	}
+	if c.Opt.Rotate && len(servers) > 1 {
+		k := int(atomic.AddUint32(&s.rotate, 1)-1) % len(servers)
+		servers = append(append([]net.IP(nil), servers[k:]...), servers[:k]...)
+	}
+
+	attempts := int(c.Opt.Attempts)
+	if attempts <= 0 {
+		attempts = 1
+	}
+	for attempt := 0; attempt < attempts; attempt++ {
+		for i, ip := range servers {
+			// glibc res_send: the timeout doubles with every round
+			// and is split among the nameservers.
+			timeout := time.Duration(c.Opt.TimeoutSecs) * time.Second << uint(attempt)
+			if attempt > 0 {
+				timeout /= time.Duration(len(servers))
+			}
+			if timeout < time.Second {
+				timeout = time.Second
+			}
+
+			m := newQuery(name, stype, sclass, true, c.Opt.Edns0)
+			reply, e := stubExchange(ctx, m, ip, timeout)
+			if e != nil {
+				if err = ctx.Err(); err != nil {
+					return
+				}
+
+				if s.log.Level >= dns.LOG_DEBUG {
+					s.log.Log("stub %q @ %s (server %d, attempt %d): %s", name, ip, i, attempt, e)
+				}
+				continue
+			}
+
+			switch reply.RCODE {
+			case msg.RC_SERVER_FAILURE, msg.RC_NOT_IMPLEMENETD, msg.RC_REFUSED:
+				if s.log.Level >= dns.LOG_DEBUG {
+					s.log.Log("stub %q @ %s: %s", name, ip, reply.RCODE)
+				}
+				y.Msg, y.Server = reply, ip
+				continue
+			}
+
+			y.Msg, y.Server = reply, ip
+			y.Result, y.Answer, y.Redirects = stubResult(reply, name, stype, sclass)
+			return
+		}
+	}
+	return
+}
+
+// stubExchange sends m to ip over UDP, retrying over TCP if the reply is
+// truncated.
+func stubExchange(ctx context.Context, m *msg.Message, ip net.IP, timeout time.Duration) (reply *msg.Message, err error) {
+	ctx2, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(transport.Port))
+	if reply, err = (&transport.UDP{Addr: addr}).Exchange(ctx2, m); err == nil {
+		err = checkReply(m, reply)
+	}
+	if err != nil || !reply.TC {
+		return
+	}
+
+	if reply, err = (&transport.TCP{Addr: addr}).Exchange(ctx2, m); err == nil {
+		err = checkReply(m, reply)
+	}
+	return
+}
+
+// stubResult analyzes a recursive reply to a query for name.
+func stubResult(reply *msg.Message, name string, stype msg.QType, sclass rr.Class) (result LookupResult, answer, redirects rr.RRs) {
+	owner := strings.ToLower(name)
+	seen := map[string]bool{owner: true}
+chain:
+	for {
+		for _, rec := range reply.Answer {
+			if rec.Class != sclass || rec.Type != rr.TYPE_CNAME || stype == msg.QTYPE_CNAME || strings.ToLower(rec.Name) != owner {
+				continue
+			}
+
+			redirects = append(redirects, rec)
+			if owner = strings.ToLower(rec.RData.(*rr.CNAME).Name); seen[owner] {
+				result = LookupAliasLoop
+				return
+			}
+
+			seen[owner] = true
+			continue chain
+		}
+		break
+	}
+
+	answer, _ = reply.Answer.Filter(func(rec *rr.RR) bool {
+		return rec.Class == sclass && (stype == msg.QTYPE_STAR || rec.Type == rr.Type(stype)) && strings.ToLower(rec.Name) == owner
+	})
+	switch {
+	case reply.RCODE == msg.RC_NAME_ERROR && len(redirects) != 0:
+		result = LookupAliasError
+	case reply.RCODE == msg.RC_NAME_ERROR:
+		result = LookupNameError
+	case reply.RCODE != msg.RC_NO_ERROR:
+		result = LookupFail
+	case len(answer) == 0:
+		result = LookupDataNotFound
+	case len(redirects) != 0:
+		result = LookupAliased
+	default:
+		result = LookupOK
+	}
+	return
+}
+
+// GetHostByName looks up the IN A or AAAA addresses of name. The A
+// addresses are queried first and the AAAA ones only if there are no A
+// addresses. If preferIPv6 == true or the resolv.conf inet6 option is set then
+// the order is reversed. The addresses are ordered according to the
+// resolv.conf sortlist, if any.
+func (s *Stub) GetHostByName(name string, preferIPv6 bool) (ipList []net.IP, redirects rr.RRs, err error) {
+	return s.GetHostByNameContext(context.Background(), name, preferIPv6)
+}
+
+// GetHostByNameContext is like GetHostByName but the lookup is bounded by ctx.
+func (s *Stub) GetHostByNameContext(ctx context.Context, name string, preferIPv6 bool) (ipList []net.IP, redirects rr.RRs, err error) {
+	var c *resolv.Conf
+	if c, err = s.conf(); err != nil {
+		return
+	}
+
+	qtypes := []msg.QType{msg.QTYPE_A, msg.QTYPE_AAAA}
+	if preferIPv6 || c.Opt.Inet6 {
+		qtypes[0], qtypes[1] = qtypes[1], qtypes[0]
+	}
+	var y *StubReply
+	for _, qtype := range qtypes {
+		if y, err = s.LookupContext(ctx, name, qtype, rr.CLASS_IN); err != nil {
+			return
+		}
+
+		redirects = y.Redirects
+		for _, rec := range y.Answer {
+			switch x := rec.RData.(type) {
+			case *rr.A:
+				ipList = append(ipList, x.Address)
+			case *rr.AAAA:
+				ipList = append(ipList, x.Address)
+			}
+		}
+		if len(ipList) != 0 {
+			sortIPs(c.Sortlist, ipList)
+			return
+		}
+	}
+	err = fmt.Errorf(LookupResultStr[y.Result])
+	return
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"net"
+	"sync"
+	"time"
+)
+
+// TraceKind is the type of TraceStep.Kind.
+type TraceKind int
+
+// Values of TraceKind.
+const (
+	TraceCache    TraceKind = iota // Data found in the cache.
+	TraceQuery                     // A query was sent to a server.
+	TraceReferral                  // A referral to the servers of a zone was followed.
+	TraceAlias                     // A CNAME was followed.
+	TraceResult                    // A lookup completed.
+)
+
+var traceKindStr = map[TraceKind]string{
+	TraceCache:    "cache",
+	TraceQuery:    "query",
+	TraceReferral: "referral",
+	TraceAlias:    "alias",
+	TraceResult:   "result",
+}
+
+func (k TraceKind) String() string {
+	if s, ok := traceKindStr[k]; ok {
+		return s
+	}
+
+	return fmt.Sprintf("%d!", int(k))
+}
+
+// TraceStep is a step of a lookup recorded in a Trace. Fields not
+// applicable to the step Kind are zero.
+type TraceStep struct {
+	Kind     TraceKind
+	Time     time.Time     // When the step happened, when the query was sent for TraceQuery.
+	Duration time.Duration // Of the exchange, TraceQuery only.
+	Name     string        // The name looked up or asked.
+	Type     msg.QType     // The type looked up or asked.
+	Zone     string        // The zone the server asked is a nameserver of, or the zone referred to.
+	Server   string        // The name of the server asked.
+	IP       net.IP        // The IP of the server asked.
+	Reply    *msg.Message  // The reply, nil if none was received.
+	RRs      rr.RRs        // Cached RRs, the CNAME followed or the referral NS RRs.
+	Result   LookupResult  // TraceResult only.
+	Err      error         // Of the exchange or of the lookup.
+	Note     string        // Additional information.
+}
+
+func (s *TraceStep) String() string {
+	b := &bytes.Buffer{}
+	switch s.Kind {
+	case TraceQuery:
+		fmt.Fprintf(b, ";; %s %s @ %s(%s) zone %s", s.Name, s.Type, s.IP, s.Server, s.Zone)
+		switch {
+		case s.Err != nil:
+			fmt.Fprintf(b, ": %s", s.Err)
+		case s.Reply != nil:
+			fmt.Fprintf(b, ": %s AA=%t in %s", s.Reply.RCODE, s.Reply.AA, s.Duration)
+			for _, rrs := range []rr.RRs{s.Reply.Answer, s.Reply.Authority} {
+				for _, rec := range rrs {
+					fmt.Fprintf(b, "\n%s", rec)
+				}
+			}
+		}
+	case TraceResult:
+		fmt.Fprintf(b, ";; %s %s: %s", s.Name, s.Type, LookupResultStr[s.Result])
+		if s.Err != nil {
+			fmt.Fprintf(b, ": %s", s.Err)
+		}
+	default:
+		fmt.Fprintf(b, ";; %s %s %s", s.Kind, s.Name, s.Type)
+		if s.Zone != "" {
+			fmt.Fprintf(b, " zone %s", s.Zone)
+		}
+		for _, rec := range s.RRs {
+			fmt.Fprintf(b, "\n%s", rec)
+		}
+	}
+	if s.Note != "" {
+		fmt.Fprintf(b, " (%s)", s.Note)
+	}
+	return b.String()
+}
+
+// Trace records the steps of lookups. A Trace is attached to a lookup by
+// passing a context returned from WithTrace to any of the Context methods of
+// Resolver. Background lookups of nameserver addresses started by the lookup
+// are recorded too. Trace is safe for concurrent use.
+type Trace struct {
+	steps []TraceStep
+	lock  sync.Mutex
+}
+
+// Steps returns a copy of the steps recorded so far.
+func (t *Trace) Steps() []TraceStep {
+	t.lock.Lock()         // X++
+	defer t.lock.Unlock() // X--
+
+	return append([]TraceStep(nil), t.steps...)
+}
+
+// String formats t similarly to `dig +trace`.
+func (t *Trace) String() string {
+	b := &bytes.Buffer{}
+	for _, s := range t.Steps() {
+		fmt.Fprintf(b, "%s\n", &s)
+	}
+	return b.String()
+}
+
+// add records s. add is a nop if t is nil.
+func (t *Trace) add(s TraceStep) {
+	if t == nil {
+		return
+	}
+
+	if s.Time.IsZero() {
+		s.Time = time.Now()
+	}
+	t.lock.Lock()         // X++
+	defer t.lock.Unlock() // X--
+
+	t.steps = append(t.steps, s)
+}
+
+type traceKey struct{}
+
+// WithTrace returns a copy of ctx which makes the Resolver record the steps
+// of lookups using ctx in t.
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// traceFrom returns the Trace attached to ctx, if any.
+func traceFrom(ctx context.Context) *Trace {
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// LookupTrace is like LookupContext but it also returns the Trace of the
+// lookup.
+func (r *Resolver) LookupTrace(ctx context.Context, sname string, stype msg.QType, sclass rr.Class, rd bool) (answer, redirects rr.RRs, result LookupResult, t *Trace, err error) {
+	t = &Trace{}
+	answer, redirects, result, err = r.LookupContext(WithTrace(ctx, t), sname, stype, sclass, rd)
+	return
+}
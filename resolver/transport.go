@@ -0,0 +1,59 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"github.com/cznic/dns/transport"
+	"net"
+)
+
+// SetTransport makes r exchange all its messages, over any network, using the
+// Exchangers returned by f. A nil f restores the default transports: UDP,
+// pooled TCP connections, DoT (see SetDoT) and DoH (see SetDoH). The
+// caching, coalescing, statistics and anti-spoofing checks of r apply to the
+// messages of f as well.
+func (r *Resolver) SetTransport(f transport.Factory) {
+	r.transport.Store(&f)
+}
+
+// Transport returns the transport Factory of r or nil if r uses the default
+// transports.
+func (r *Resolver) Transport() transport.Factory {
+	if f, _ := r.transport.Load().(*transport.Factory); f != nil {
+		return *f
+	}
+
+	return nil
+}
+
+// exchanger returns the Exchanger used to talk to ip over network.
+func (r *Resolver) exchanger(network string, ip net.IP) (x transport.Exchanger, err error) {
+	if f := r.Transport(); f != nil {
+		return f(network, ip)
+	}
+
+	switch network {
+	case "tls":
+		if c := r.dotClient(ip); c != nil {
+			return c, nil
+		}
+
+		return nil, errDoTOff
+	case "https":
+		if c := r.DoH(); c != nil {
+			return c, nil
+		}
+
+		return nil, errDoHOff
+	case "tcp":
+		if r.tcp != nil {
+			return r.tcp.Factory(network, ip)
+		}
+	}
+
+	return transport.Default(network, ip)
+}
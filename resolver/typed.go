@@ -0,0 +1,295 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package resolver
+
+import (
+	"context"
+	"fmt"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"math/rand"
+	"sort"
+	"strings"
+)
+
+// tlsaType is the TLSA RR type assigned by rfc6698. rr.TYPE_TLSA and
+// msg.QTYPE_TLSA carry the pre-standard experimental value, RRs of type
+// tlsaType are thus decoded as rr.RDATA.
+const tlsaType = 52
+
+// CAA is the RDATA of a CAA RR (rfc8659). The rr package has no CAA RData
+// type, CAA RRs are decoded as rr.RDATA.
+type CAA struct {
+	Flags byte   // Bit 7 is the Issuer Critical Flag.
+	Tag   string // The property identifier, e.g. "issue" or "iodef".
+	Value string // The property value.
+}
+
+func (c *CAA) String() string {
+	return fmt.Sprintf("%d %s %q", c.Flags, c.Tag, c.Value)
+}
+
+// Critical returns whether the Issuer Critical Flag of c is set.
+func (c *CAA) Critical() bool {
+	return c.Flags&0x80 != 0
+}
+
+// parseCAA decodes b as the RDATA of a CAA RR.
+func parseCAA(b []byte) (c *CAA, err error) {
+	if len(b) < 2 || len(b) < 2+int(b[1]) || b[1] == 0 {
+		return nil, fmt.Errorf("invalid CAA RDATA % x", b)
+	}
+
+	n := 2 + int(b[1])
+	return &CAA{b[0], string(b[2:n]), string(b[n:])}, nil
+}
+
+// parseTLSA decodes b as the RDATA of a TLSA RR.
+func parseTLSA(b []byte) (t *rr.TLSA, err error) {
+	if len(b) < 3 {
+		return nil, fmt.Errorf("invalid TLSA RDATA % x", b)
+	}
+
+	return &rr.TLSA{rr.TLSAUsage(b[0]), rr.TLSASelector(b[1]), rr.TLSAMatchingType(b[2]), append([]byte(nil), b[3:]...)}, nil
+}
+
+// lookupIN returns the IN class RRs of type qtype for name. CNAMEs are
+// followed.
+func (r *Resolver) lookupIN(ctx context.Context, name string, qtype msg.QType) (rrs rr.RRs, result LookupResult, err error) {
+	rrs, _, result, err = r.LookupContext(ctx, name, qtype, rr.CLASS_IN, false)
+	return
+}
+
+type byPref []*rr.MX
+
+// Implementation of sort.Interface
+func (b byPref) Len() int {
+	return len(b)
+}
+
+// Implementation of sort.Interface
+func (b byPref) Less(i, j int) bool {
+	return b[i].Preference < b[j].Preference
+}
+
+// Implementation of sort.Interface
+func (b byPref) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// LookupMX returns the MX RRs of name sorted by preference. MXs of the same
+// preference are randomly ordered.
+func (r *Resolver) LookupMX(name string) (mx []*rr.MX, result LookupResult, err error) {
+	return r.LookupMXContext(context.Background(), name)
+}
+
+// LookupMXContext is like LookupMX but the lookup is bounded by ctx.
+func (r *Resolver) LookupMXContext(ctx context.Context, name string) (mx []*rr.MX, result LookupResult, err error) {
+	var rrs rr.RRs
+	if rrs, result, err = r.lookupIN(ctx, name, msg.QTYPE_MX); err != nil {
+		return
+	}
+
+	for _, rec := range rrs {
+		if x, ok := rec.RData.(*rr.MX); ok {
+			mx = append(mx, x)
+		}
+	}
+	for i := range mx {
+		j := rand.Intn(i + 1)
+		mx[i], mx[j] = mx[j], mx[i]
+	}
+	sort.Stable(byPref(mx))
+	return
+}
+
+type byPriority []*rr.SRV
+
+// Implementation of sort.Interface
+func (b byPriority) Len() int {
+	return len(b)
+}
+
+// Implementation of sort.Interface
+func (b byPriority) Less(i, j int) bool {
+	return b[i].Priority < b[j].Priority
+}
+
+// Implementation of sort.Interface
+func (b byPriority) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// sortSRV orders srv by priority and within the same priority by the
+// weighted random selection of rfc2782.
+func sortSRV(srv []*rr.SRV) {
+	sort.Stable(byPriority(srv))
+	for i := 0; i < len(srv); {
+		j := i + 1
+		for j < len(srv) && srv[j].Priority == srv[i].Priority {
+			j++
+		}
+		weighted(srv[i:j])
+		i = j
+	}
+}
+
+// weighted orders srv, all of the same priority, by the rfc2782 weighted
+// random selection.
+func weighted(srv []*rr.SRV) {
+	// "arrange all SRV RRs (that have not been ordered yet) in any order,
+	// except that all those with weight 0 are placed at the beginning of
+	// the list."
+	sort.SliceStable(srv, func(i, j int) bool { return srv[i].Weight == 0 && srv[j].Weight != 0 })
+	for len(srv) > 1 {
+		sum := 0
+		for _, x := range srv {
+			sum += int(x.Weight)
+		}
+		n := rand.Intn(sum + 1)
+		k := 0
+		for run := 0; k < len(srv); k++ {
+			if run += int(srv[k].Weight); run >= n {
+				break
+			}
+		}
+		x := srv[k]
+		copy(srv[1:k+1], srv[:k])
+		srv[0] = x
+		srv = srv[1:]
+	}
+}
+
+// LookupSRV looks up the SRV RRs of _service._proto.name, or of name if both
+// service and proto are empty, and returns them ordered by priority and
+// weight as described in rfc2782. The returned cname is the name the SRV RRs
+// are owned by. A single SRV RR with the target "." means that the service is
+// decidedly not available, no SRV RRs are returned then.
+func (r *Resolver) LookupSRV(service, proto, name string) (cname string, srv []*rr.SRV, result LookupResult, err error) {
+	return r.LookupSRVContext(context.Background(), service, proto, name)
+}
+
+// LookupSRVContext is like LookupSRV but the lookup is bounded by ctx.
+func (r *Resolver) LookupSRVContext(ctx context.Context, service, proto, name string) (cname string, srv []*rr.SRV, result LookupResult, err error) {
+	if service != "" || proto != "" {
+		name = fmt.Sprintf("_%s._%s.%s", service, proto, name)
+	}
+	var rrs rr.RRs
+	if rrs, result, err = r.lookupIN(ctx, name, msg.QTYPE_SRV); err != nil {
+		return
+	}
+
+	for _, rec := range rrs {
+		if x, ok := rec.RData.(*rr.SRV); ok {
+			cname = rec.Name
+			srv = append(srv, x)
+		}
+	}
+	if len(srv) == 1 && srv[0].Target == "." {
+		return cname, nil, result, nil
+	}
+
+	sortSRV(srv)
+	return
+}
+
+// LookupTXT returns the TXT RRs of name, the character strings of every RR
+// concatenated.
+func (r *Resolver) LookupTXT(name string) (txt []string, result LookupResult, err error) {
+	return r.LookupTXTContext(context.Background(), name)
+}
+
+// LookupTXTContext is like LookupTXT but the lookup is bounded by ctx.
+func (r *Resolver) LookupTXTContext(ctx context.Context, name string) (txt []string, result LookupResult, err error) {
+	var rrs rr.RRs
+	if rrs, result, err = r.lookupIN(ctx, name, msg.QTYPE_TXT); err != nil {
+		return
+	}
+
+	for _, rec := range rrs {
+		if x, ok := rec.RData.(*rr.TXT); ok {
+			txt = append(txt, strings.Join(x.S, ""))
+		}
+	}
+	return
+}
+
+// LookupCAA returns the CAA RRs of name. Note that rfc8659 requires to climb
+// the DNS tree towards the root when name has no CAA RRs, LookupCAA does not
+// do that.
+func (r *Resolver) LookupCAA(name string) (caa []*CAA, result LookupResult, err error) {
+	return r.LookupCAAContext(context.Background(), name)
+}
+
+// LookupCAAContext is like LookupCAA but the lookup is bounded by ctx.
+func (r *Resolver) LookupCAAContext(ctx context.Context, name string) (caa []*CAA, result LookupResult, err error) {
+	var rrs rr.RRs
+	if rrs, result, err = r.lookupIN(ctx, name, msg.QTYPE_CAA); err != nil {
+		return
+	}
+
+	for _, rec := range rrs {
+		if x, ok := rec.RData.(*rr.RDATA); ok {
+			var c *CAA
+			if c, err = parseCAA(*x); err != nil {
+				return nil, result, err
+			}
+
+			caa = append(caa, c)
+		}
+	}
+	return
+}
+
+// LookupTLSA returns the TLSA RRs of _port._proto.name, e.g.
+// LookupTLSA(443, "tcp", "www.example.com.").
+func (r *Resolver) LookupTLSA(port int, proto, name string) (tlsa []*rr.TLSA, result LookupResult, err error) {
+	return r.LookupTLSAContext(context.Background(), port, proto, name)
+}
+
+// LookupTLSAContext is like LookupTLSA but the lookup is bounded by ctx.
+func (r *Resolver) LookupTLSAContext(ctx context.Context, port int, proto, name string) (tlsa []*rr.TLSA, result LookupResult, err error) {
+	var rrs rr.RRs
+	if rrs, result, err = r.lookupIN(ctx, fmt.Sprintf("_%d._%s.%s", port, proto, name), tlsaType); err != nil {
+		return
+	}
+
+	for _, rec := range rrs {
+		switch x := rec.RData.(type) {
+		case *rr.TLSA:
+			tlsa = append(tlsa, x)
+		case *rr.RDATA:
+			var t *rr.TLSA
+			if t, err = parseTLSA(*x); err != nil {
+				return nil, result, err
+			}
+
+			tlsa = append(tlsa, t)
+		}
+	}
+	return
+}
+
+// LookupSSHFP returns the SSHFP RRs of name.
+func (r *Resolver) LookupSSHFP(name string) (sshfp []*rr.SSHFP, result LookupResult, err error) {
+	return r.LookupSSHFPContext(context.Background(), name)
+}
+
+// LookupSSHFPContext is like LookupSSHFP but the lookup is bounded by ctx.
+func (r *Resolver) LookupSSHFPContext(ctx context.Context, name string) (sshfp []*rr.SSHFP, result LookupResult, err error) {
+	var rrs rr.RRs
+	if rrs, result, err = r.lookupIN(ctx, name, msg.QTYPE_SSHFP); err != nil {
+		return
+	}
+
+	for _, rec := range rrs {
+		if x, ok := rec.RData.(*rr.SSHFP); ok {
+			sshfp = append(sshfp, x)
+		}
+	}
+	return
+}
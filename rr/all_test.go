@@ -15,6 +15,7 @@ import (
 	"github.com/cznic/strutil"
 	"math/rand"
 	"net"
+	"os"
 	"strconv"
 	"strings"
 	"testing"
@@ -23,8 +24,9 @@ import (
 
 var optDev = flag.Bool("dev", false, "enable dev helpers")
 
-func init() {
+func TestMain(m *testing.M) {
 	flag.Parse()
+	os.Exit(m.Run())
 }
 
 type enctest struct {
@@ -150,6 +152,9 @@ func TestLOC(t *testing.T) {
 		min := rand.Intn(60)
 		secs := rand.Intn(60000)
 		positive := rand.Intn(100)&1 != 0
+		if deg == 0 && min == 0 && secs == 0 {
+			positive = true // the equator and the prime meridian have no sign
+		}
 		x := loc.EncDMTS(deg, min, secs, positive)
 		gd, gm, gs, gp := loc.DecDMTS(x)
 		if gd != deg || gm != min || gs != secs || gp != positive {
@@ -161,6 +166,23 @@ func TestLOC(t *testing.T) {
 			)
 		}
 	}
+
+	for i, test := range []struct {
+		deg, min, secs int
+		positive       bool
+		s              string
+	}{
+		{0, 36, 48100, false, "0 36 48.100 S 0 36 48.100 W"},
+		{0, 0, 1, false, "0 0 0.001 S 0 0 0.001 W"},
+		{0, 0, 0, false, "0 0 0.000 N 0 0 0.000 E"},
+		{0, 36, 48100, true, "0 36 48.100 N 0 36 48.100 E"},
+	} {
+		x := loc.EncDMTS(test.deg, test.min, test.secs, test.positive)
+		loc.Latitude, loc.Longitude = x, x
+		if g := loc.String(); !strings.HasPrefix(g, test.s+" ") {
+			t.Fatal(i, g, test.s)
+		}
+	}
 }
 
 func Test0(t *testing.T) {
@@ -1130,3 +1152,81 @@ func TestTSIG(t *testing.T) {
 		t.Errorf("\n%v\n!=\n%v", g, e)
 	}
 }
+
+// rdataTypes are the types having a RDATA decoder.
+var rdataTypes = []Type{
+	TYPE_A, TYPE_AAAA, TYPE_AFSDB, TYPE_CERT, TYPE_CNAME, TYPE_DHCID,
+	TYPE_DLV, TYPE_DNAME, TYPE_DNSKEY, TYPE_DS, TYPE_GPOS, TYPE_HINFO,
+	TYPE_HIP, TYPE_IPSECKEY, TYPE_ISDN, TYPE_KEY, TYPE_KX, TYPE_LOC,
+	TYPE_MB, TYPE_MD, TYPE_MF, TYPE_MG, TYPE_MINFO, TYPE_MR,
+	TYPE_MX, TYPE_NAPTR, TYPE_NODATA, TYPE_NS, TYPE_NSAP, TYPE_NSAP_PTR,
+	TYPE_NXDOMAIN, TYPE_NSEC, TYPE_NSEC3, TYPE_NSEC3PARAM, TYPE_NULL, TYPE_OPT,
+	TYPE_PTR, TYPE_PX, TYPE_RP, TYPE_RRSIG, TYPE_RT, TYPE_SIG,
+	TYPE_SOA, TYPE_SPF, TYPE_SRV, TYPE_SSHFP, TYPE_TA, TYPE_TALINK,
+	TYPE_TKEY, TYPE_TLSA, TYPE_TSIG, TYPE_TXT, TYPE_URI, TYPE_WKS,
+	TYPE_X25,
+}
+
+// rrWire returns the wire format of a RR of typ owned by the root having the
+// RDATA b.
+func rrWire(typ Type, b []byte) []byte {
+	w := []byte{0, byte(typ >> 8), byte(typ), 0, 1, 0, 0, 0, 0, byte(len(b) >> 8), byte(len(b))}
+	return append(w, b...)
+}
+
+func FuzzRData(f *testing.F) {
+	samples := []*RR{
+		{".", TYPE_A, CLASS_IN, 0, &A{net.IPv4(192, 0, 2, 1)}},
+		{".", TYPE_MX, CLASS_IN, 0, &MX{10, "mail.example.com."}},
+		{".", TYPE_SOA, CLASS_IN, 0, &SOA{"ns.example.", "hostmaster.example.", 1, 2, 3, 4, 5}},
+		{".", TYPE_TXT, CLASS_IN, 0, &TXT{[]string{"a", "bc"}}},
+		{".", TYPE_OPT, CLASS_IN, 0, &OPT{[]OPT_DATA{{10, []byte{1, 2, 3, 4, 5, 6, 7, 8}}}}},
+		{".", TYPE_SRV, CLASS_IN, 0, &SRV{1, 2, 53, "ns.example."}},
+	}
+	for _, rec := range samples {
+		w := dns.NewWirebuf()
+		rec.RData.Encode(w)
+		for i, typ := range rdataTypes {
+			if typ == rec.Type {
+				f.Add(uint8(i), w.Buf)
+			}
+		}
+	}
+	for i := range rdataTypes {
+		f.Add(uint8(i), []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20})
+	}
+	f.Fuzz(func(t *testing.T, i uint8, b []byte) {
+		if int(i) >= len(rdataTypes) || len(b) > 0xffff {
+			return
+		}
+
+		w := rrWire(rdataTypes[i], b)
+		var rec RR
+		pos := 0
+		if err := rec.Decode(w, &pos, nil); err != nil {
+			if _, ok := err.(*dns.DecodeError); !ok {
+				t.Fatal(10, err)
+			}
+			return
+		}
+
+		if pos != len(w) {
+			t.Fatal(20, pos, len(w))
+		}
+	})
+}
+
+func TestEXT_RCODE(t *testing.T) {
+	x := &EXT_RCODE{RCODE: 0x12, Version: 0x34, Z: 0x5678}
+	w := dns.NewWirebuf()
+	x.Encode(w)
+	var y EXT_RCODE
+	p := 0
+	if err := y.Decode(w.Buf, &p, nil); err != nil {
+		t.Fatal(10, err)
+	}
+
+	if y != *x || y.ToTTL() != 0x12345678 {
+		t.Fatal(20, &y)
+	}
+}
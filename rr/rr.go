@@ -195,6 +195,16 @@ func quote(s string) string {
 	return dns.CharString(s).Quoted()
 }
 
+// bufp0 returns a pointer to b[pos] for a WireDecodeSniffer or an underflow
+// error if pos is out of b.
+func bufp0(b []byte, pos int) (p *byte, err error) {
+	if pos < 0 || pos >= len(b) {
+		return nil, &dns.DecodeError{Offset: pos, Err: dns.ErrUnderflow}
+	}
+
+	return &b[pos], nil
+}
+
 // A holds the zone A RData
 type A struct {
 	Address net.IP // A 32 bit Internet address.
@@ -207,7 +217,11 @@ func (rd *A) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *A) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*ip4)(&rd.Address).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -234,7 +248,11 @@ func (rd *AAAA) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *AAAA) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*ip6)(&rd.Address).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -270,7 +288,11 @@ func (rd *AFSDB) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *AFSDB) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.SubType).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -371,7 +393,11 @@ func (rd *CERT) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *CERT) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Type).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -419,7 +445,11 @@ func (rd CNAME) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *CNAME) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.Name).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -477,7 +507,11 @@ func (rd DHCID) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *DHCID) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	n := len(b) - *pos
 	if n <= 0 {
 		return fmt.Errorf("(*DHCID).Decode: no key data")
@@ -508,7 +542,11 @@ func (rd DNAME) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *DNAME) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.Name).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -601,7 +639,11 @@ func (c Class) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (c *Class) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(c).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -648,7 +690,11 @@ func (rd *DLV) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *DLV) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.KeyTag).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -737,7 +783,11 @@ func (rd *DNSKEY) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *DNSKEY) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Flags).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -791,7 +841,11 @@ func (rd *DS) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *DS) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.KeyTag).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -926,7 +980,11 @@ func (rd *GPOS) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *GPOS) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	var s dns.CharString
 
 	if err = s.Decode(b, pos, sniffer); err != nil {
@@ -979,7 +1037,11 @@ func (rd *HINFO) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *HINFO) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.CharString)(&rd.Cpu).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1073,7 +1135,11 @@ func (rd *HIP) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *HIP) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	var hitLength dns.Octet
 	if err = hitLength.Decode(b, pos, sniffer); err != nil {
 		return
@@ -1088,7 +1154,7 @@ func (rd *HIP) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err er
 		return
 	}
 
-	if *pos+int(hitLength) > len(b)+1 {
+	if *pos+int(hitLength) > len(b) {
 		return fmt.Errorf("(*rr.HIP).Decode() - buffer underflow")
 	}
 
@@ -1096,7 +1162,7 @@ func (rd *HIP) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err er
 	copy(rd.HIT, b[*pos:*pos+int(hitLength)])
 	*pos += int(hitLength)
 
-	if *pos+int(pkLength) > len(b)+1 {
+	if *pos+int(pkLength) > len(b) {
 		return fmt.Errorf("(*rr.HIP).Decode() - buffer underflow")
 	}
 
@@ -1296,7 +1362,11 @@ func (rd *IPSECKEY) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *IPSECKEY) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octet)(&rd.Precedence).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1315,14 +1385,14 @@ func (rd *IPSECKEY) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (e
 	case GatewayNone:
 		// nop
 	case GatewayIPV4:
-		if *pos+4 > len(b)+1 {
+		if *pos+4 > len(b) {
 			return errors.New("(*IPSECKEY.Decode(): Buffer undeflow")
 		}
 
 		rd.Gateway = net.IP(append([]byte{}, b[*pos:*pos+4]...))
 		*pos += 4
 	case GatewayIPV6:
-		if *pos+16 > len(b)+1 {
+		if *pos+16 > len(b) {
 			return errors.New("(*IPSECKEY.Decode(): Buffer undeflow")
 		}
 
@@ -1398,7 +1468,11 @@ func (rd *ISDN) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *ISDN) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.CharString)(&rd.ISDN).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1475,7 +1549,11 @@ func (rd *KEY) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *KEY) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Flags).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1523,7 +1601,11 @@ func (rd *KX) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *KX) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Preference).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1639,32 +1721,36 @@ func (rd *LOC) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *LOC) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
-	if (*dns.Octet)(&rd.Version).Decode(b, pos, sniffer); err != nil {
+	p0, err := bufp0(b, *pos)
+	if err != nil {
 		return
 	}
 
-	if (*dns.Octet)(&rd.Size).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octet)(&rd.Version).Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
-	if (*dns.Octet)(&rd.HorizPre).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octet)(&rd.Size).Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
-	if (*dns.Octet)(&rd.VertPre).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octet)(&rd.HorizPre).Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
-	if (*dns.Octets4)(&rd.Longitude).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octet)(&rd.VertPre).Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
-	if (*dns.Octets4)(&rd.Latitude).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octets4)(&rd.Longitude).Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
-	if (*dns.Octets4)(&rd.Altitude).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octets4)(&rd.Latitude).Decode(b, pos, sniffer); err != nil {
+		return
+	}
+
+	if err = (*dns.Octets4)(&rd.Altitude).Decode(b, pos, sniffer); err != nil {
 		return
 	}
 
@@ -1704,9 +1790,13 @@ func (rd *LOC) EncAlt(cm int64) {
 	rd.Altitude = uint32(cm + 10000000)
 }
 
+// DecDMTS decodes the latitude or longitude x. The sign is that of x, not of
+// its degrees, which are zero for the first degree south or west. The equator
+// and the prime meridian are positive.
 func (rd *LOC) DecDMTS(x uint32) (deg, min, ts int, positive bool) {
 	deg = rd.Degrees(x)
-	if positive = deg >= 0; !positive {
+	positive = x >= 1<<31
+	if deg < 0 {
 		deg = -deg
 	}
 	min = rd.Minutes(x)
@@ -1800,7 +1890,11 @@ func (rd *MB) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *MB) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.MADNAME).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1835,7 +1929,11 @@ func (rd *MD) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *MD) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.MADNAME).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1870,7 +1968,11 @@ func (rd *MF) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *MF) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.MADNAME).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1899,7 +2001,11 @@ func (rd *MG) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *MG) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.MGNAME).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1941,7 +2047,11 @@ func (rd *MINFO) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *MINFO) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.RMAILBX).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -1975,7 +2085,11 @@ func (rd *MR) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *MR) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.NEWNAME).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2009,7 +2123,11 @@ func (rd *MX) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *MX) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Preference).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2120,7 +2238,11 @@ func (rd *NAPTR) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *NAPTR) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Order).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2168,7 +2290,11 @@ func (rd *NODATA) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *NODATA) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = rd.Type.Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2217,7 +2343,11 @@ func (rd *NS) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *NS) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.NSDName).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2261,7 +2391,11 @@ func (rd *NSAP) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err e
 		return
 	}
 
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	rd.NSAP = append([]byte{}, b[*pos:]...)
 	*pos = len(b)
 	if sniffer != nil {
@@ -2286,7 +2420,11 @@ func (rd NSAP_PTR) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *NSAP_PTR) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.Name).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2364,7 +2502,11 @@ func (rd *NSEC) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *NSEC) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.NextDomainName).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2410,7 +2552,11 @@ func (rd *NSEC3) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *NSEC3) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = rd.NSEC3PARAM.Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2482,7 +2628,11 @@ func (rd *NSEC3PARAM) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *NSEC3PARAM) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octet)(&rd.HashAlgorithm).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2573,7 +2723,11 @@ func (rd *OPT_DATA) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *OPT_DATA) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Code).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2617,7 +2771,11 @@ func (rd *OPT) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *OPT) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	for *pos < len(b) {
 		v := OPT_DATA{}
 		if err = v.Decode(b, pos, sniffer); err != nil {
@@ -2661,13 +2819,17 @@ func (rd *EXT_RCODE) ToTTL() int32 {
 
 // Implementation of dns.Wirer
 func (rd *EXT_RCODE) Encode(b *dns.Wirebuf) {
-	n := dns.Octets4(uint32(rd.RCODE<<24) | uint32(rd.Version<<16) | uint32(rd.Z))
+	n := dns.Octets4(uint32(rd.RCODE)<<24 | uint32(rd.Version)<<16 | uint32(rd.Z))
 	n.Encode(b)
 }
 
 // Implementation of dns.Wirer
 func (rd *EXT_RCODE) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	var n dns.Octets4
 	if err = n.Decode(b, pos, sniffer); err != nil {
 		return
@@ -2697,7 +2859,11 @@ func (rd *PTR) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *PTR) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.PTRDName).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2733,7 +2899,11 @@ func (rd *PX) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *PX) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Preference).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2774,7 +2944,11 @@ func (rd *RDATA) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err
 		return
 	}
 
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	n := len(b) - *pos
 	*rd = b[*pos:]
 	*pos += n
@@ -2848,11 +3022,11 @@ func (rr *RR) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rr *RR) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	if *pos >= len(b) {
-		return fmt.Errorf("(*rr.RR).Decode() - buffer underflow, len(b) %d(%#x), pos %d(%#x)", len(b), len(b), *pos, *pos)
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
 	}
 
-	p0 := &b[*pos]
 	if err = (*dns.DomainName)(&rr.Name).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -2992,14 +3166,22 @@ func (rr *RR) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err err
 		rr.RData = &RDATA{}
 	}
 
-	if *pos+int(rdlength) > len(b) {
-		return fmt.Errorf("malformed packet, len(RData) %d, len(buf) %d", rdlength, len(b)-*pos)
+	rd := *pos
+	if rd+int(rdlength) > len(b) {
+		return &dns.DecodeError{Offset: rd - 2, Err: dns.ErrRDLength}
 	}
 
 	if rdlength != 0 {
-		if err = rr.RData.Decode(b[:*pos+int(rdlength)], pos, sniffer); err != nil {
+		if err = rr.RData.Decode(b[:rd+int(rdlength)], pos, sniffer); err != nil {
+			if _, ok := err.(*dns.DecodeError); !ok {
+				err = &dns.DecodeError{Offset: rd, Err: err}
+			}
 			return
 		}
+
+		if *pos != rd+int(rdlength) {
+			return &dns.DecodeError{Offset: rd, Err: dns.ErrRDLength}
+		}
 	}
 
 	if sniffer != nil {
@@ -3505,7 +3687,11 @@ func (rd *RP) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *RP) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.Mbox).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -3573,7 +3759,11 @@ func (rd *RRSIG) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *RRSIG) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Type).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -3662,7 +3852,11 @@ func (rd *RT) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *RT) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Preference).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -3732,7 +3926,11 @@ func (rd *SIG) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *SIG) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Type).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -3837,23 +4035,27 @@ func (rd *SOA) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *SOA) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.MName).Decode(b, pos, sniffer); err != nil {
 		return
 	}
 	if err = (*dns.DomainName)(&rd.RName).Decode(b, pos, sniffer); err != nil {
 		return
 	}
-	if (*dns.Octets4)(&rd.Serial).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octets4)(&rd.Serial).Decode(b, pos, sniffer); err != nil {
 		return
 	}
-	if (*dns.Octets4)(&rd.Refresh).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octets4)(&rd.Refresh).Decode(b, pos, sniffer); err != nil {
 		return
 	}
-	if (*dns.Octets4)(&rd.Retry).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octets4)(&rd.Retry).Decode(b, pos, sniffer); err != nil {
 		return
 	}
-	if (*dns.Octets4)(&rd.Expire).Decode(b, pos, sniffer); err != nil {
+	if err = (*dns.Octets4)(&rd.Expire).Decode(b, pos, sniffer); err != nil {
 		return
 	}
 	if err = (*dns.Octets4)(&rd.Minimum).Decode(b, pos, sniffer); err != nil {
@@ -3903,7 +4105,11 @@ func (rd *SPF) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *SPF) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	s := []string{}
 	for *pos < len(b) {
 		var part dns.CharString
@@ -3993,7 +4199,11 @@ func (rd *SRV) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *SRV) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Priority).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -4079,7 +4289,11 @@ func (rd *SSHFP) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *SSHFP) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octet)(&rd.Algorithm).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -4160,7 +4374,11 @@ func (rd *TA) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *TA) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.KeyTag).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -4234,7 +4452,11 @@ func (rd *TALINK) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *TALINK) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.PrevName).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -4354,7 +4576,11 @@ func (rd *TKEY) Encode(b *dns.Wirebuf) {
 // Implementation of dns.Wirer
 func (rd *TKEY) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
 	//BUG Supports times only up to 2106-02-07 06:28:15 +0000 UTC
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.Algorithm).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -4386,7 +4612,7 @@ func (rd *TKEY) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err e
 	}
 
 	n := int(u16)
-	if *pos+n > len(b)+1 {
+	if *pos+n > len(b) {
 		return fmt.Errorf("(*rr.TKEY).Decode() - buffer underflow")
 	}
 
@@ -4399,7 +4625,7 @@ func (rd *TKEY) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err e
 	}
 
 	n = int(u16)
-	if *pos+n > len(b)+1 {
+	if *pos+n > len(b) {
 		return fmt.Errorf("(*rr.TKEY).Decode() - buffer underflow")
 	}
 
@@ -4526,7 +4752,11 @@ func (rd *TLSA) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *TLSA) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octet)(&rd.Usage).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -4540,7 +4770,7 @@ func (rd *TLSA) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err e
 	}
 
 	rd.Certificate = nil
-	if *pos < len(b)-1 {
+	if *pos < len(b) {
 		rd.Certificate = make([]byte, len(b[*pos:]))
 		copy(rd.Certificate, b[*pos:])
 		*pos = len(b)
@@ -4647,7 +4877,11 @@ func (rd *TSIG) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *TSIG) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.DomainName)(&rd.AlgorithmName).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -4675,7 +4909,7 @@ func (rd *TSIG) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err e
 	}
 
 	n := int(u16)
-	if *pos+n > len(b)+1 {
+	if *pos+n > len(b) {
 		return fmt.Errorf("(*rr.TSIG).Decode() - buffer underflow")
 	}
 
@@ -4700,7 +4934,7 @@ func (rd *TSIG) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err e
 	}
 
 	n = int(u16)
-	if *pos+n > len(b)+1 {
+	if *pos+n > len(b) {
 		return fmt.Errorf("(*rr.TSIG).Decode() - buffer underflow")
 	}
 
@@ -4741,7 +4975,11 @@ func (rd *TXT) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *TXT) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	s := []string{}
 	for *pos < len(b) {
 		var part dns.CharString
@@ -4821,7 +5059,11 @@ func (rd *URI) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *URI) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(&rd.Priority).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -4901,7 +5143,11 @@ func (rd *WKS) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *WKS) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*ip4)(&rd.Address).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -5163,7 +5409,11 @@ func (t Type) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (t *Type) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.Octets2)(t).Decode(b, pos, sniffer); err != nil {
 		return
 	}
@@ -5192,7 +5442,11 @@ func (rd *X25) Encode(b *dns.Wirebuf) {
 
 // Implementation of dns.Wirer
 func (rd *X25) Decode(b []byte, pos *int, sniffer dns.WireDecodeSniffer) (err error) {
-	p0 := &b[*pos]
+	p0, err := bufp0(b, *pos)
+	if err != nil {
+		return
+	}
+
 	if err = (*dns.CharString)(&rd.PSDN).Decode(b, pos, sniffer); err != nil {
 		return
 	}
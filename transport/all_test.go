@@ -0,0 +1,280 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package transport
+
+import (
+	"context"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func echo(query *msg.Message, remote net.Addr) *msg.Message {
+	query.QR = true
+	query.Answer = rr.RRs{&rr.RR{query.Question[0].QNAME, rr.TYPE_A, rr.CLASS_IN, 60, &rr.A{net.IPv4(192, 0, 2, 1)}}}
+	return query
+}
+
+func TestMem(t *testing.T) {
+	n := MemNet{"192.0.2.1": msg.ResponderFunc(echo)}
+	x, err := n.Factory("udp", net.IPv4(192, 0, 2, 1))
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	m := msg.New()
+	m.Question.A("example.com.", rr.CLASS_IN)
+	reply, err := x.Exchange(context.Background(), m)
+	if err != nil || reply.ID != m.ID || len(reply.Answer) != 1 {
+		t.Fatal(20, reply, err)
+	}
+
+	if len(m.Answer) != 0 {
+		t.Fatal(30, "query modified")
+	}
+
+	if _, err = n.Factory("udp", net.IPv4(192, 0, 2, 2)); err == nil {
+		t.Fatal(40)
+	}
+
+	x = &Mem{Responder: msg.ResponderFunc(func(*msg.Message, net.Addr) *msg.Message { return nil })}
+	if _, err = x.Exchange(context.Background(), m); err != ErrNoReply {
+		t.Fatal(50, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err = (&Mem{Responder: msg.ResponderFunc(echo)}).Exchange(ctx, m); err != context.Canceled {
+		t.Fatal(60, err)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	c, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(10, err)
+	}
+
+	defer c.Close()
+
+	go func() {
+		b := make([]byte, UDPBufSize)
+		n, addr, err := c.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		query := &msg.Message{}
+		p := 0
+		if query.Decode(b[:n], &p, nil) != nil {
+			return
+		}
+
+		w := dns.NewWirebuf()
+		echo(query, addr).Encode(w)
+		c.WriteTo(w.Buf, addr)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	m := msg.New()
+	m.Question.A("example.com.", rr.CLASS_IN)
+	reply, err := (&UDP{Addr: c.LocalAddr().String()}).Exchange(ctx, m)
+	if err != nil || reply.ID != m.ID || len(reply.Answer) != 1 {
+		t.Fatal(20, reply, err)
+	}
+
+	// Nobody replies now.
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err = (&UDP{Addr: c.LocalAddr().String()}).Exchange(ctx, m); err != context.DeadlineExceeded {
+		t.Fatal(30, err)
+	}
+
+	if _, err = Default("tls", net.IPv4(127, 0, 0, 1)); err == nil {
+		t.Fatal(40)
+	}
+}
+
+// tcpServer serves echo on TCP, delaying the replies to "slow" QNAMEs.
+// Replies to queries with the edns-tcp-keepalive option carry *timeout, in
+// units of 100 ms, unless it is negative.
+func tcpServer(t *testing.T, timeout *int32) (addr string, accepted *int32, stop func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted = new(int32)
+	r := msg.ResponderFunc(func(query *msg.Message, remote net.Addr) *msg.Message {
+		if strings.HasPrefix(query.Question[0].QNAME, "slow") {
+			time.Sleep(100 * time.Millisecond)
+		}
+		ka := false
+		for _, rec := range query.Additional {
+			if rec.Type == rr.TYPE_OPT {
+				for _, v := range rec.RData.(*rr.OPT).Values {
+					ka = ka || v.Code == OptTCPKeepalive && len(v.Data) == 0
+				}
+			}
+		}
+		reply := echo(query, remote)
+		reply.Additional = nil
+		if t := atomic.LoadInt32(timeout); ka && t >= 0 {
+			reply.Additional = rr.RRs{&rr.RR{".", rr.TYPE_OPT, rr.Class(4096), 0, &rr.OPT{[]rr.OPT_DATA{{OptTCPKeepalive, []byte{byte(t >> 8), byte(t)}}}}}}
+		}
+		return reply
+	})
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			atomic.AddInt32(accepted, 1)
+			go msg.ServeStream(c, r, 0)
+		}
+	}()
+	return l.Addr().String(), accepted, func() { l.Close() }
+}
+
+func TestPool(t *testing.T) {
+	timeout := int32(-1)
+	addr, accepted, stop := tcpServer(t, &timeout)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p := &Pool{IdleTimeout: 200 * time.Millisecond}
+	defer p.Close()
+
+	// Pipelined, out of order.
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			m := msg.New()
+			name := "example.com."
+			if i == 0 {
+				name = "slow.example.com."
+			}
+			m.Question.A(name, rr.CLASS_IN)
+			reply, err := p.Exchange(ctx, addr, m)
+			if err == nil && (reply.ID != m.ID || reply.Question[0].QNAME != name) {
+				t.Error(i, reply)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(10, err)
+		}
+	}
+
+	if n := atomic.LoadInt32(accepted); n != 1 {
+		t.Fatal(20, n)
+	}
+
+	// Idle timeout.
+	if n := p.conns(addr); n != 1 {
+		t.Fatal(30, n)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if n := p.conns(addr); n != 0 {
+		t.Fatal(40, n)
+	}
+
+	// Server closed connection is replaced transparently.
+	m := msg.New()
+	m.Question.A("example.com.", rr.CLASS_IN)
+	x := p.Exchanger(addr)
+	if _, err := x.Exchange(ctx, m); err != nil {
+		t.Fatal(50, err)
+	}
+
+	p.lock.Lock()
+	p.servers[addr].conns[0].conn.Close()
+	p.lock.Unlock()
+	if _, err := x.Exchange(ctx, m); err != nil || atomic.LoadInt32(accepted) != 3 {
+		t.Fatal(60, err, atomic.LoadInt32(accepted))
+	}
+
+	p.Close()
+	if _, err := x.Exchange(ctx, m); err != ErrPoolClosed {
+		t.Fatal(70, err)
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	timeout := int32(0)
+	addr, accepted, stop := tcpServer(t, &timeout)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	p := &Pool{}
+	defer p.Close()
+
+	m := msg.New()
+	m.Question.A("example.com.", rr.CLASS_IN)
+	if _, err := p.Exchange(ctx, addr, m); err != nil || p.conns(addr) != 1 {
+		t.Fatal(10, err, p.conns(addr))
+	}
+
+	// No option without EDNS.
+	if _, ok := KeepaliveTimeout(m); ok {
+		t.Fatal(20)
+	}
+
+	opt := &rr.RR{".", rr.TYPE_OPT, rr.Class(4096), 0, &rr.OPT{}}
+	m.Additional = rr.RRs{opt}
+	reply, err := p.Exchange(ctx, addr, m)
+	if err != nil {
+		t.Fatal(30, err)
+	}
+
+	if len(opt.RData.(*rr.OPT).Values) != 0 {
+		t.Fatal(40, "query modified")
+	}
+
+	// TIMEOUT 0: the server asks to close the connection.
+	if d, ok := KeepaliveTimeout(reply); !ok || d != 0 || p.conns(addr) != 0 {
+		t.Fatal(50, d, ok, p.conns(addr))
+	}
+
+	atomic.StoreInt32(&timeout, 1)
+	if reply, err = p.Exchange(ctx, addr, m); err != nil {
+		t.Fatal(60, err)
+	}
+
+	if d, ok := KeepaliveTimeout(reply); !ok || d != 100*time.Millisecond {
+		t.Fatal(70, d, ok)
+	}
+
+	// The server idle timeout overrides DefaultIdleTimeout.
+	time.Sleep(300 * time.Millisecond)
+	if n := p.conns(addr); n != 0 || atomic.LoadInt32(accepted) != 2 {
+		t.Fatal(80, n, atomic.LoadInt32(accepted))
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+package transport
+
+import (
+	"context"
+	"errors"
+	"github.com/cznic/dns/msg"
+	"github.com/cznic/dns/rr"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// OptTCPKeepalive is the edns-tcp-keepalive option code (rfc7828/3.1).
+const OptTCPKeepalive = 11
+
+// DefaultIdleTimeout is the Pool IdleTimeout used if none is set. It is the
+// idle timeout rfc7766/6.2.3 recommends to servers.
+const DefaultIdleTimeout = 10 * time.Second
+
+// DefaultMaxPending is the Pool MaxPending used if none is set.
+const DefaultMaxPending = 100
+
+// ErrPoolClosed is returned by Pool.Exchange after the Pool was closed.
+var ErrPoolClosed = errors.New("transport: pool closed")
+
+// Pool keeps TCP connections to DNS servers open and pipelines the exchanges
+// over them (rfc7766/6.2.1). Concurrent queries to a server share a
+// connection, its replies are matched to the queries by their IDs, in
+// whatever order they arrive. A connection with no exchange in progress is
+// closed after an idle timeout. Queries having an OPT RR carry the
+// edns-tcp-keepalive option and the idle timeout the server signals in its
+// replies, if any, takes precedence over the IdleTimeout of the Pool
+// (rfc7828/3.2). The fields of a Pool must not be changed after its first
+// Exchange. A zero Pool is ready to use. Pool is safe for concurrent use.
+type Pool struct {
+	// A connection is closed when no exchange is in progress for
+	// IdleTimeout. Zero means DefaultIdleTimeout.
+	IdleTimeout time.Duration
+	// At most MaxPending exchanges are pipelined over a connection, more
+	// open another one. Zero means DefaultMaxPending.
+	MaxPending int
+
+	closed  bool
+	lock    sync.Mutex
+	servers map[string]*poolServer
+}
+
+// poolServer is the state of a Pool for one server address.
+type poolServer struct {
+	conns   []*poolConn
+	dialing chan struct{} // non nil while a connection is being dialed
+}
+
+// poolConn is a connection of a Pool.
+type poolConn struct {
+	conn    *msg.StreamConn
+	busy    int           // exchanges in progress
+	idle    time.Duration // idle timeout
+	closing bool          // the server asked to close the connection
+	timer   *time.Timer   // idle timer
+}
+
+// usable returns whether an exchange may be started over c.
+func (c *poolConn) usable(maxPending int) bool {
+	return !c.closing && c.busy < maxPending && c.conn.Err() == nil
+}
+
+// Exchange sends m to the server at addr, "host:port", over a pooled TCP
+// connection and returns the reply. The exchange, including establishing a
+// connection if necessary, is bounded by ctx. m is not modified, see
+// msg.StreamConn.Exchange for how the query and reply IDs are handled.
+func (p *Pool) Exchange(ctx context.Context, addr string, m *msg.Message) (reply *msg.Message, err error) {
+	q := keepalive(m)
+	for {
+		c, reused, err := p.get(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		reply, err = c.conn.Exchange(ctx, q)
+		p.put(addr, c, reply)
+		if err == nil || !reused || ctx.Err() != nil || c.conn.Err() == nil {
+			return reply, err
+		}
+
+		// The reused connection failed, most probably it was closed by
+		// the server. Try once more with a new one.
+	}
+}
+
+// Exchanger returns an Exchanger of the server at addr using p.
+func (p *Pool) Exchanger(addr string) Exchanger {
+	return &pooled{p, addr}
+}
+
+// Factory is a Factory returning the Exchangers of p for "tcp" and those of
+// Default for any other network.
+func (p *Pool) Factory(network string, ip net.IP) (Exchanger, error) {
+	if network != "tcp" {
+		return Default(network, ip)
+	}
+
+	return p.Exchanger(net.JoinHostPort(ip.String(), strconv.Itoa(Port))), nil
+}
+
+// Close closes all connections of p. Exchanges in progress fail and later
+// ones return ErrPoolClosed.
+func (p *Pool) Close() (err error) {
+	p.lock.Lock()         // X++
+	defer p.lock.Unlock() // X--
+
+	p.closed = true
+	for addr, s := range p.servers {
+		for _, c := range s.conns {
+			p.drop(c)
+		}
+		delete(p.servers, addr)
+	}
+	return
+}
+
+// get returns a connection to addr with the exchange accounted to it. The
+// returned reused reports whether the connection was already established.
+func (p *Pool) get(ctx context.Context, addr string) (c *poolConn, reused bool, err error) {
+	maxPending := p.MaxPending
+	if maxPending == 0 {
+		maxPending = DefaultMaxPending
+	}
+	for {
+		p.lock.Lock() // X++
+		if p.closed {
+			p.lock.Unlock() // X--
+			return nil, false, ErrPoolClosed
+		}
+
+		if p.servers == nil {
+			p.servers = map[string]*poolServer{}
+		}
+		s := p.servers[addr]
+		if s == nil {
+			s = &poolServer{}
+			p.servers[addr] = s
+		}
+		for _, c := range s.conns {
+			if c.usable(maxPending) {
+				c.busy++
+				if c.timer != nil {
+					c.timer.Stop()
+				}
+				p.lock.Unlock() // X--
+				return c, true, nil
+			}
+		}
+
+		if ch := s.dialing; ch != nil {
+			p.lock.Unlock() // X--
+			select {
+			case <-ch:
+				continue
+			case <-ctx.Done():
+				return nil, false, ctx.Err()
+			}
+		}
+
+		ch := make(chan struct{})
+		s.dialing = ch
+		p.lock.Unlock() // X--
+
+		var d net.Dialer
+		nc, err := d.DialContext(ctx, "tcp", addr)
+
+		p.lock.Lock() // X++
+		s.dialing = nil
+		close(ch)
+		switch {
+		case err != nil:
+		case p.closed:
+			nc.Close()
+			err = ErrPoolClosed
+		default:
+			idle := p.IdleTimeout
+			if idle == 0 {
+				idle = DefaultIdleTimeout
+			}
+			c = &poolConn{conn: msg.NewStreamConn(nc), busy: 1, idle: idle}
+			s.conns = append(s.conns, c)
+		}
+		p.lock.Unlock() // X--
+		return c, false, err
+	}
+}
+
+// put ends an exchange over c, which got reply, if any. The idle timeout
+// signalled by the server in reply, if any, is applied to c. A connection
+// with no exchange left is closed if it failed or the server asked to close
+// it, otherwise the idle timer is started.
+func (p *Pool) put(addr string, c *poolConn, reply *msg.Message) {
+	p.lock.Lock()         // X++
+	defer p.lock.Unlock() // X--
+
+	c.busy--
+	if reply != nil {
+		if t, ok := KeepaliveTimeout(reply); ok {
+			if t == 0 {
+				c.closing = true // rfc7828/3.3.2
+			} else {
+				c.idle = t
+			}
+		}
+	}
+	if c.busy != 0 {
+		return
+	}
+
+	if c.closing || c.conn.Err() != nil || p.closed {
+		p.remove(addr, c)
+		return
+	}
+
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.idle, func() { p.expire(addr, c) })
+		return
+	}
+
+	c.timer.Reset(c.idle)
+}
+
+// expire closes c if it is still idle.
+func (p *Pool) expire(addr string, c *poolConn) {
+	p.lock.Lock()         // X++
+	defer p.lock.Unlock() // X--
+
+	if c.busy == 0 {
+		p.remove(addr, c)
+	}
+}
+
+// remove closes c and removes it from the connections of addr.
+func (p *Pool) remove(addr string, c *poolConn) {
+	p.drop(c)
+	s := p.servers[addr]
+	if s == nil {
+		return
+	}
+
+	for i, v := range s.conns {
+		if v == c {
+			s.conns = append(s.conns[:i], s.conns[i+1:]...)
+			break
+		}
+	}
+	if len(s.conns) == 0 && s.dialing == nil {
+		delete(p.servers, addr)
+	}
+}
+
+// drop closes c and stops its idle timer.
+func (p *Pool) drop(c *poolConn) {
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.conn.Close()
+}
+
+// conns returns the number of connections to addr.
+func (p *Pool) conns(addr string) int {
+	p.lock.Lock()         // X++
+	defer p.lock.Unlock() // X--
+
+	if s := p.servers[addr]; s != nil {
+		return len(s.conns)
+	}
+
+	return 0
+}
+
+// pooled is the Exchanger of one server of a Pool.
+type pooled struct {
+	pool *Pool
+	addr string
+}
+
+// Exchange implements Exchanger.
+func (x *pooled) Exchange(ctx context.Context, m *msg.Message) (reply *msg.Message, err error) {
+	return x.pool.Exchange(ctx, x.addr, m)
+}
+
+// keepalive returns m with the edns-tcp-keepalive option, without a TIMEOUT
+// (rfc7828/3.2.1), added to its OPT RR. m is returned as is if it has no OPT
+// RR or the option is already there. m itself is not modified.
+func keepalive(m *msg.Message) *msg.Message {
+	for i, rec := range m.Additional {
+		if rec.Type != rr.TYPE_OPT {
+			continue
+		}
+
+		opt := rec.RData.(*rr.OPT)
+		for _, v := range opt.Values {
+			if v.Code == OptTCPKeepalive {
+				return m
+			}
+		}
+
+		q := *m
+		q.Additional = append(rr.RRs(nil), m.Additional...)
+		x := *rec
+		x.RData = &rr.OPT{append(append([]rr.OPT_DATA(nil), opt.Values...), rr.OPT_DATA{OptTCPKeepalive, nil})}
+		q.Additional[i] = &x
+		return &q
+	}
+	return m
+}
+
+// KeepaliveTimeout returns the idle timeout signalled by the
+// edns-tcp-keepalive option of m (rfc7828/3.1). The returned ok is false if m
+// has no such option with a TIMEOUT.
+func KeepaliveTimeout(m *msg.Message) (t time.Duration, ok bool) {
+	for _, rec := range m.Additional {
+		if rec.Type != rr.TYPE_OPT {
+			continue
+		}
+
+		for _, v := range rec.RData.(*rr.OPT).Values {
+			if v.Code == OptTCPKeepalive && len(v.Data) == 2 {
+				return time.Duration(int(v.Data[0])<<8|int(v.Data[1])) * 100 * time.Millisecond, true
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2011 CZ.NIC z.s.p.o. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// blame: jnml, labs.nic.cz
+
+// Package transport abstracts the exchange of DNS messages.
+//
+// An Exchanger sends a query and returns the reply, hiding whether that
+// happens over UDP, TCP, TLS, HTTPS or in memory. A Factory returns the
+// Exchanger to use for a nameserver, which allows e.g. testing a resolver
+// against fake authoritative servers without any sockets.
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/cznic/dns"
+	"github.com/cznic/dns/dot"
+	"github.com/cznic/dns/msg"
+	"math"
+	"net"
+	"time"
+)
+
+// Port is the DNS port.
+const Port = 53
+
+// UDPBufSize is the default receive buffer size of UDP.
+const UDPBufSize = 4096
+
+// ErrNoReply is returned by Mem when its Responder does not reply.
+var ErrNoReply = errors.New("transport: no reply")
+
+// Exchanger exchanges DNS messages. *dot.Client and *doh.Client are
+// Exchangers as well.
+type Exchanger interface {
+	// Exchange sends m and returns the reply. The exchange is bounded by
+	// ctx. If ctx is done before the exchange completes, ctx.Err() is
+	// returned. Checking the reply answers m is up to the caller.
+	Exchange(ctx context.Context, m *msg.Message) (reply *msg.Message, err error)
+}
+
+// Factory returns the Exchanger used to talk to the nameserver at ip over
+// network, which is "udp", "tcp", "tls" or "https".
+type Factory func(network string, ip net.IP) (Exchanger, error)
+
+// Default is the Factory of the UDP and TCP Exchangers of port 53. It returns
+// an error for any other network.
+func Default(network string, ip net.IP) (x Exchanger, err error) {
+	addr := net.JoinHostPort(ip.String(), fmt.Sprint(Port))
+	switch network {
+	case "udp":
+		return &UDP{Addr: addr}, nil
+	case "tcp":
+		return &TCP{Addr: addr}, nil
+	}
+
+	return nil, fmt.Errorf("transport.Default: unsupported network %q", network)
+}
+
+// aLongTimeAgo is a deadline in the past used to abort pending I/O.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// exchange dials addr using network and exchanges m over the new connection.
+func exchange(ctx context.Context, network, addr string, m *msg.Message, rxbuf []byte) (reply *msg.Message, err error) {
+	var d net.Dialer
+	var c net.Conn
+	if c, err = d.DialContext(ctx, network, addr); err != nil {
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return
+	}
+
+	defer c.Close()
+
+	// The I/O is aborted when ctx is done, which is thus always reported
+	// as the reason.
+	stop := context.AfterFunc(ctx, func() { c.SetDeadline(aLongTimeAgo) })
+	defer stop()
+
+	if _, reply, err = m.ExchangeBuf(c, rxbuf); err != nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return
+}
+
+// UDP exchanges messages over UDP, using a new socket for every exchange.
+type UDP struct {
+	Addr    string // The server "host:port".
+	BufSize int    // Size of the receive buffer, UDPBufSize if zero.
+}
+
+// Exchange implements Exchanger.
+func (u *UDP) Exchange(ctx context.Context, m *msg.Message) (reply *msg.Message, err error) {
+	n := u.BufSize
+	if n == 0 {
+		n = UDPBufSize
+	}
+	return exchange(ctx, "udp", u.Addr, m, make([]byte, n))
+}
+
+// TCP exchanges messages over TCP, using a new connection for every
+// exchange.
+type TCP struct {
+	Addr string // The server "host:port".
+}
+
+// Exchange implements Exchanger.
+func (t *TCP) Exchange(ctx context.Context, m *msg.Message) (reply *msg.Message, err error) {
+	return exchange(ctx, "tcp", t.Addr, m, make([]byte, math.MaxUint16))
+}
+
+// TLS returns an Exchanger of the DNS over TLS server at addr. It is a
+// shorthand for dot.NewClient.
+func TLS(addr string, config *tls.Config, pins ...[]byte) Exchanger {
+	return dot.NewClient(addr, config, pins...)
+}
+
+// Mem exchanges messages with a Responder in memory. The query and the reply
+// are passed encoded and decoded again, as if they went over the wire.
+type Mem struct {
+	Responder msg.Responder
+	Remote    net.Addr // The client address passed to the Responder, may be nil.
+}
+
+// wire returns a copy of m obtained by encoding and decoding it.
+func wire(m *msg.Message) (y *msg.Message, err error) {
+	w := dns.NewWirebuf()
+	m.Encode(w)
+	y = &msg.Message{}
+	p := 0
+	if err = y.Decode(w.Buf, &p, nil); err != nil {
+		y = nil
+	}
+	return
+}
+
+// Exchange implements Exchanger. If the Responder does not reply, ErrNoReply
+// is returned immediately.
+func (x *Mem) Exchange(ctx context.Context, m *msg.Message) (reply *msg.Message, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+
+	var query *msg.Message
+	if query, err = wire(m); err != nil {
+		return
+	}
+
+	if reply = x.Responder.Respond(query, x.Remote); reply == nil {
+		return nil, ErrNoReply
+	}
+
+	return wire(reply)
+}
+
+// MemNet maps nameserver IPs, in their String form, to Responders.
+type MemNet map[string]msg.Responder
+
+// Factory is a Factory returning Mem Exchangers of the Responders of n for
+// any network. An error is returned for IPs not in n.
+func (n MemNet) Factory(network string, ip net.IP) (Exchanger, error) {
+	r, ok := n[ip.String()]
+	if !ok {
+		return nil, fmt.Errorf("transport.MemNet: no route to %s", ip)
+	}
+
+	return &Mem{Responder: r}, nil
+}
@@ -7,10 +7,52 @@
 package dns
 
 import (
+	"errors"
 	"fmt"
 	"strings"
 )
 
+// Limits of decoded domain names.
+const (
+	MaxLabelLen = 63  // Maximum length of a label (RFC 1035/2.3.4).
+	MaxNameLen  = 255 // Maximum wire length of a domain name (RFC 1035/2.3.4).
+	// Maximum number of compression pointers followed while decoding a
+	// domain name. No name of MaxNameLen needs more.
+	MaxPointers = (MaxNameLen+1)/2 - 2
+)
+
+// Errors of decoding malformed wire data, see DecodeError.
+var (
+	ErrCount        = errors.New("record counts exceed the message length")
+	ErrLabelLen     = errors.New("label longer than 63 octets or of an unsupported type")
+	ErrNameLen      = errors.New("domain name longer than 255 octets")
+	ErrPointer      = errors.New("compression pointer does not point backward")
+	ErrPointerLimit = errors.New("too many compression pointers")
+	ErrRDLength     = errors.New("RDATA length mismatch")
+	ErrTrailing     = errors.New("trailing data")
+	ErrUnderflow    = errors.New("buffer underflow")
+)
+
+// DecodeError reports malformed wire data.
+type DecodeError struct {
+	Section string // The message section, like "answer", if known.
+	Offset  int    // Offset in the wire data where the problem was found.
+	Err     error  // What is wrong, e.g. ErrPointer.
+}
+
+func (e *DecodeError) Error() string {
+	if e.Section != "" {
+		return fmt.Sprintf("decode %s at offset %d(%#x): %v", e.Section, e.Offset, e.Offset, e.Err)
+	}
+
+	return fmt.Sprintf("decode at offset %d(%#x): %v", e.Offset, e.Offset, e.Err)
+}
+
+// Unwrap returns e.Err.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
 // CharString is a DNS <character-string> (RFC 1035) implementing Wirer.
 type CharString string
 
@@ -29,16 +71,16 @@ func (s CharString) Encode(b *Wirebuf) {
 func (s *CharString) Decode(b []byte, pos *int, sniffer WireDecodeSniffer) (err error) {
 	p := *pos
 	if p >= len(b) {
-		return fmt.Errorf("CharString.Decode() - buffer underflow")
+		return &DecodeError{Offset: p, Err: ErrUnderflow}
 	}
 
 	p0 := &b[*pos]
 	n := int(b[p])
-	*pos += 1
 	if p+n >= len(b) {
-		return fmt.Errorf("CharString.Decode() - buffer underflow")
-
+		return &DecodeError{Offset: p, Err: ErrUnderflow}
 	}
+
+	*pos += 1
 	*s = CharString(b[p+1 : p+n+1])
 	*pos += n
 	if sniffer != nil {
@@ -81,45 +123,86 @@ func (s DomainName) Encode(b *Wirebuf) {
 }
 
 func (s *DomainName) decode(b []byte, pos *int) (err error) {
-	labels := []string{}
-	label := CharString("")
+	var labels []string
+	end, err := WalkName(b, *pos, func(label []byte) { labels = append(labels, string(label)) })
+	if err != nil {
+		return
+	}
+
+	*pos = end
+	*s = "."
+	if len(labels) != 0 {
+		*s = DomainName(strings.Join(labels, ".") + ".")
+	}
+	return
+}
+
+// WalkName checks the domain name in wire format at b[pos:], following
+// compression pointers (RFC 1035/4.1.4) within the limits MaxLabelLen,
+// MaxNameLen and MaxPointers, and returns the offset of the byte following the
+// name at pos. If f is not nil, it is called with every label of the name
+// except the root one. The label passed to f is a slice of b. WalkName does
+// not allocate unless it fails.
+func WalkName(b []byte, pos int, f func(label []byte)) (end int, err error) {
+	p, lim := pos, pos
+	end = -1
+	n, ptrs := 0, 0
 	for {
-		if *pos >= len(b) {
-			return fmt.Errorf("DomainName.Decode() - buffer underflow")
+		if p < 0 || p >= len(b) {
+			return 0, &DecodeError{Offset: p, Err: ErrUnderflow}
 		}
 
-		if b[*pos]&0xC0 == 0xC0 { // compressed
-			var ptr Octets2
-			if err = ptr.Decode(b, pos, nil); err != nil {
-				return
+		c := int(b[p])
+		if c&0xC0 == 0xC0 { // compressed
+			if p+2 > len(b) {
+				return 0, &DecodeError{Offset: p, Err: ErrUnderflow}
 			}
 
-			p := int(ptr) ^ 0xC000
-			var name DomainName
-			if err = name.decode(b, &p); err != nil {
-				return
+			if ptrs++; ptrs > MaxPointers {
+				return 0, &DecodeError{Offset: p, Err: ErrPointerLimit}
 			}
 
-			labels = append(labels, string(name))
-			*s = DomainName(strings.Join(labels, "."))
-			return
+			// Every pointer must point before the labels the
+			// previous one pointed to, which rules out loops.
+			q := (c&0x3F)<<8 | int(b[p+1])
+			if q >= lim {
+				return 0, &DecodeError{Offset: p, Err: ErrPointer}
+			}
+
+			if end < 0 {
+				end = p + 2
+			}
+			p, lim = q, q
+			continue
 		}
 
-		if err = label.Decode(b, pos, nil); err != nil {
-			return
+		if c > MaxLabelLen { // 0x40 and 0x80 label types
+			return 0, &DecodeError{Offset: p, Err: ErrLabelLen}
 		}
 
-		labels = append(labels, string(label))
-		if label == "" {
-			if len(labels) != 1 {
-				*s = DomainName(strings.Join(labels, "."))
-			} else {
-				*s = "."
-			}
-			return
+		if n += c + 1; n > MaxNameLen {
+			return 0, &DecodeError{Offset: p, Err: ErrNameLen}
+		}
+
+		if p+c >= len(b) {
+			return 0, &DecodeError{Offset: p, Err: ErrUnderflow}
+		}
+
+		if c == 0 {
+			p++
+			break
 		}
 
+		if f != nil {
+			f(b[p+1 : p+1+c])
+		}
+		p += c + 1
+	}
+
+	if end < 0 {
+		end = p
 	}
+	return
 }
 
 // Implementation of Wirer
@@ -147,7 +230,7 @@ func (o Octet) Encode(b *Wirebuf) {
 func (o *Octet) Decode(b []byte, pos *int, sniffer WireDecodeSniffer) (err error) {
 	p := *pos
 	if p+1 > len(b) {
-		return fmt.Errorf("Octet.Decode() - buffer underflow")
+		return &DecodeError{Offset: p, Err: ErrUnderflow}
 	}
 	p0 := &b[*pos]
 	*o = Octet(b[p])
@@ -170,7 +253,7 @@ func (n Octets2) Encode(b *Wirebuf) {
 func (n *Octets2) Decode(b []byte, pos *int, sniffer WireDecodeSniffer) (err error) {
 	p := *pos
 	if p+2 > len(b) {
-		return fmt.Errorf("Octets2.Decode() - buffer underflow")
+		return &DecodeError{Offset: p, Err: ErrUnderflow}
 	}
 	p0 := &b[*pos]
 	*n = Octets2(b[p])<<8 + Octets2(b[p+1])
@@ -193,7 +276,7 @@ func (n Octets4) Encode(b *Wirebuf) {
 func (n *Octets4) Decode(b []byte, pos *int, sniffer WireDecodeSniffer) (err error) {
 	p := *pos
 	if p+4 > len(b) {
-		return fmt.Errorf("Octets4.Decode() - buffer underflow")
+		return &DecodeError{Offset: p, Err: ErrUnderflow}
 	}
 	p0 := &b[*pos]
 	*n = Octets4(b[p])<<24 + Octets4(b[p+1])<<16 + Octets4(b[p+2])<<8 + Octets4(b[p+3])